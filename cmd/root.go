@@ -9,6 +9,8 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/stregouet/hydra-ldap/internal/config"
+	"github.com/stregouet/hydra-ldap/internal/hydra"
+	"github.com/stregouet/hydra-ldap/internal/ldap"
 	"github.com/stregouet/hydra-ldap/internal/logging"
 	"github.com/stregouet/hydra-ldap/internal/oidc"
 	"github.com/stregouet/hydra-ldap/internal/server"
@@ -38,6 +40,12 @@ func Run(cfgFile string) {
 		panic(fmt.Sprintf("error in config %v", err))
 	}
 	logging.Setup(&c.Log, c.Dev)
+	if err := hydra.Setup(&c.Hydra); err != nil {
+		panic(fmt.Sprintf("cannot setup hydra %v", err))
+	}
+	if err := ldap.Setup(&c.Ldap); err != nil {
+		panic(fmt.Sprintf("cannot setup ldap %v", err))
+	}
 	if err := oidc.Setup(&c.SelfService); err != nil {
 		panic(fmt.Sprintf("cannot setup oauth client %v", err))
 	}
@@ -1,33 +1,143 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
 	"github.com/stregouet/hydra-ldap/internal/hydra"
 	"github.com/stregouet/hydra-ldap/internal/ldap"
 	"github.com/stregouet/hydra-ldap/internal/logging"
 	"github.com/stregouet/hydra-ldap/internal/oidc"
+	"github.com/stregouet/hydra-ldap/internal/store"
 )
 
 type Config struct {
-	Dev         bool
-	Listen      string
-	Hydra       hydra.Config
-	Ldap        ldap.Config
-	Log         logging.Config
-	SelfService oidc.Config
+	Dev    bool
+	Listen string
+	// reverse proxies (ip or cidr) whose `X-Real-IP` and `X-Forwarded-For`
+	// headers are trusted to give ip address of user
+	TrustedProxies []string
+	Hydra          hydra.Config
+	Ldap           ldap.Config
+	Log            logging.Config
+	SelfService    oidc.Config
+	Store          store.Config
+
+	trustedNets []*net.IPNet
+}
+
+// TrustedProxy tells if `ip` is the address of a trusted reverse proxy
+func (cfg *Config) TrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range cfg.trustedNets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns ip address of user for a request received from
+// `remoteAddr`. Forwarding headers are only read from a trusted proxy.
+// `X-Forwarded-For` is read from the right, as each proxy appends address it
+// received request from while left-most entries are set by client, the first
+// address which is not a trusted proxy is the one of user.
+func (cfg *Config) ClientIP(remoteAddr string, header http.Header) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if !cfg.TrustedProxy(host) {
+		return host
+	}
+	var forwarded []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// entries on the left of an invalid one cannot be trusted
+			return host
+		}
+		host = ip.String()
+		if !cfg.TrustedProxy(host) {
+			return host
+		}
+	}
+	if len(forwarded) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// parseTrustedProxies parses trusted proxies, a single ip is a network of
+// one address
+func (cfg *Config) parseTrustedProxies() error {
+	cfg.trustedNets = nil
+	for _, proxy := range cfg.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.Wrapf(err, "invalid trusted proxy %#v", proxy)
+		}
+		cfg.trustedNets = append(cfg.trustedNets, ipNet)
+	}
+	return nil
 }
 
 func (cfg *Config) Validate() error {
+	if err := cfg.parseTrustedProxies(); err != nil {
+		return err
+	}
 	if err := cfg.Hydra.Validate(); err != nil {
 		return err
 	}
 	if err := cfg.Ldap.Validate(); err != nil {
 		return err
 	}
+	// claim scopes overridden for a client must refer to claims released to
+	// this client
+	for clientId, claims := range cfg.Hydra.ClientClaims() {
+		known := cfg.Ldap.ClaimNames(clientId)
+		for _, claim := range claims {
+			if !contains(known, claim) {
+				return fmt.Errorf("claim %#v overridden for client %#v is not mapped from any ldap attribute", claim, clientId)
+			}
+		}
+	}
 	if err := cfg.Log.Validate(); err != nil {
 		return err
 	}
 	if err := cfg.SelfService.Validate(); err != nil {
 		return err
 	}
+	if err := cfg.Store.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	cfg := &Config{TrustedProxies: []string{"10.0.0.1", "10.1.0.0/16"}}
+	assert.NoError(t, cfg.parseTrustedProxies())
+
+	for name, tc := range map[string]struct {
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		"direct request": {
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			expected:   "192.0.2.1",
+		},
+		"single proxy": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		"forged left-most entry": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, 192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		"list through several proxies": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, 192.0.2.1", "10.1.2.3"}},
+			expected:   "192.0.2.1",
+		},
+		"invalid entry": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.1, not-an-ip"}},
+			expected:   "10.0.0.1",
+		},
+		"only proxies": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.1.2.3"}},
+			expected:   "10.1.2.3",
+		},
+		"real ip header": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Real-Ip": {"192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		"invalid real ip header": {
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Real-Ip": {"192.0.2.1, 198.51.100.7"}},
+			expected:   "10.0.0.1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, cfg.ClientIP(tc.remoteAddr, tc.header))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package hydra
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authentication context class references, ordered by assurance level
+const (
+	// user was authenticated during a previous request (remembered session)
+	ACR_SESSION = "0"
+	// user typed password during this login request
+	ACR_PASSWORD = "1"
+)
+
+var acrLevels = []string{ACR_SESSION, ACR_PASSWORD}
+
+// AMR_PASSWORD is the authentication method reference of password login
+const AMR_PASSWORD = "pwd"
+
+// OidcContext contains openid connect parameters of login request
+type OidcContext struct {
+	AcrValues []string `json:"acr_values"`
+	// username (or email) suggested by client
+	LoginHint string `json:"login_hint"`
+	// preferred languages of user
+	UiLocales []string `json:"ui_locales"`
+	// how client displays login page (page, popup, touch or wap)
+	Display string `json:"display"`
+}
+
+// Prompt returns values of `prompt` parameter of authorization request
+func (r *HydraResp) Prompt() []string {
+	return strings.Fields(r.requestParam("prompt"))
+}
+
+// MaxAge returns `max_age` parameter of authorization request, ok is false
+// if it is missing
+func (r *HydraResp) MaxAge() (maxAge time.Duration, ok bool) {
+	value := r.requestParam("max_age")
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func (r *HydraResp) requestParam(name string) string {
+	u, err := url.Parse(r.RequestURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(name)
+}
+
+func (c *Config) parsedMinAcr() (map[string]string, error) {
+	result := make(map[string]string)
+	for _, minAcr := range c.MinAcr {
+		splitted := strings.Split(minAcr, ":")
+		if len(splitted) != 2 {
+			return nil, fmt.Errorf(
+				"one minimum acr is not well formatted %#v (should contain exactly one `:`)",
+				minAcr)
+		}
+		clientId, acr := splitted[0], splitted[1]
+		if acrLevel(acr) < 0 {
+			return nil, fmt.Errorf("unknown acr %#v", acr)
+		}
+		result[clientId] = acr
+	}
+	return result, nil
+}
+
+// RequiredAcr returns the lowest acr satisfying both client minimum and
+// `acr_values` requested by client, unknown requested values are ignored
+func (c *Config) RequiredAcr(resp *HydraResp) string {
+	required := ACR_SESSION
+	if acr, ok := c.minAcr[resp.Client.Id]; ok {
+		required = acr
+	}
+	// acr_values are listed by order of preference, lowest known one is
+	// enough
+	requested := -1
+	for _, acr := range resp.OidcContext.AcrValues {
+		if level := acrLevel(acr); level >= 0 && (requested < 0 || level < requested) {
+			requested = level
+		}
+	}
+	if requested > acrLevel(required) {
+		required = acrLevels[requested]
+	}
+	return required
+}
+
+// ForceLogin tells if user must type password again even if hydra allows to
+// skip login form
+func (c *Config) ForceLogin(resp *HydraResp) bool {
+	for _, prompt := range resp.Prompt() {
+		if prompt == "login" {
+			return true
+		}
+	}
+	// greater max_age is checked by hydra which does not allow to skip login
+	// when session is older
+	if maxAge, ok := resp.MaxAge(); ok && maxAge == 0 {
+		return true
+	}
+	return acrLevel(c.RequiredAcr(resp)) > acrLevel(ACR_SESSION)
+}
+
+func acrLevel(acr string) int {
+	for i, level := range acrLevels {
+		if level == acr {
+			return i
+		}
+	}
+	return -1
+}
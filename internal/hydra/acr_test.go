@@ -0,0 +1,98 @@
+package hydra
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestParams(t *testing.T) {
+	resp := HydraResp{RequestURL: "https://sso.example.com/oauth2/auth?client_id=wiki&prompt=login+consent&max_age=300"}
+	assert.Equal(t, []string{"login", "consent"}, resp.Prompt())
+	maxAge, ok := resp.MaxAge()
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, maxAge)
+
+	resp = HydraResp{RequestURL: "https://sso.example.com/oauth2/auth?client_id=wiki"}
+	assert.Empty(t, resp.Prompt())
+	_, ok = resp.MaxAge()
+	assert.False(t, ok)
+}
+
+func TestOidcContext(t *testing.T) {
+	var resp HydraResp
+	err := json.Unmarshal([]byte(`{"oidc_context": {
+		"acr_values": ["1"],
+		"login_hint": "jean.dupont@example.com",
+		"ui_locales": ["fr-CA", "en"],
+		"display": "popup"
+	}}`), &resp)
+	assert.NoError(t, err)
+	expected := OidcContext{
+		AcrValues: []string{"1"},
+		LoginHint: "jean.dupont@example.com",
+		UiLocales: []string{"fr-CA", "en"},
+		Display:   "popup",
+	}
+	assert.Equal(t, expected, resp.OidcContext)
+}
+
+func TestRequiredAcr(t *testing.T) {
+	cfg := Config{
+		Url:    "http://localhost:4445",
+		MinAcr: []string{"finance:1"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	wiki := ClientInfo{Id: "wiki"}
+	finance := ClientInfo{Id: "finance"}
+	assert.Equal(t, ACR_SESSION, cfg.RequiredAcr(&HydraResp{Client: wiki}))
+	assert.Equal(t, ACR_PASSWORD, cfg.RequiredAcr(&HydraResp{Client: finance}))
+	assert.Equal(t, ACR_PASSWORD, cfg.RequiredAcr(&HydraResp{
+		Client:      wiki,
+		OidcContext: OidcContext{AcrValues: []string{"urn:unknown", ACR_PASSWORD}},
+	}))
+	assert.Equal(t, ACR_SESSION, cfg.RequiredAcr(&HydraResp{
+		Client:      wiki,
+		OidcContext: OidcContext{AcrValues: []string{ACR_PASSWORD, ACR_SESSION}},
+	}))
+
+	cfg.MinAcr = []string{"finance:2"}
+	assert.Error(t, cfg.Validate())
+}
+
+func TestForceLogin(t *testing.T) {
+	cfg := Config{
+		Url:    "http://localhost:4445",
+		MinAcr: []string{"finance:1"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	for name, tc := range map[string]struct {
+		resp     HydraResp
+		expected bool
+	}{
+		"remembered session": {
+			resp:     HydraResp{Client: ClientInfo{Id: "wiki"}, RequestURL: "https://sso.example.com/oauth2/auth?max_age=300"},
+			expected: false,
+		},
+		"prompt login": {
+			resp:     HydraResp{Client: ClientInfo{Id: "wiki"}, RequestURL: "https://sso.example.com/oauth2/auth?prompt=login"},
+			expected: true,
+		},
+		"zero max age": {
+			resp:     HydraResp{Client: ClientInfo{Id: "wiki"}, RequestURL: "https://sso.example.com/oauth2/auth?max_age=0"},
+			expected: true,
+		},
+		"client minimum acr": {
+			resp:     HydraResp{Client: ClientInfo{Id: "finance"}},
+			expected: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, cfg.ForceLogin(&tc.resp))
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -18,15 +20,68 @@ import (
 type ClientInfo struct {
 	Id   string `json:"client_id"`
 	Name string `json:"client_name"`
+	// set on hydra 2.x clients which do not need user's consent
+	SkipConsent bool                   `json:"skip_consent"`
+	Metadata    map[string]interface{} `json:"metadata"`
 }
 
 // HydraResp contains response from Hydra
 type HydraResp struct {
-	Challenge       string     `json:"challenge"`
-	RequestedScopes []string   `json:"requested_scope"`
-	Skip            bool       `json:"skip"`
-	Subject         string     `json:"subject"`
-	Client          ClientInfo `json:"client"`
+	Challenge         string      `json:"challenge"`
+	RequestedScopes   []string    `json:"requested_scope"`
+	RequestedAudience []string    `json:"requested_access_token_audience"`
+	Skip              bool        `json:"skip"`
+	Subject           string      `json:"subject"`
+	Client            ClientInfo  `json:"client"`
+	OidcContext       OidcContext `json:"oidc_context"`
+	RequestURL        string      `json:"request_url"`
+	SessionId         string      `json:"session_id"`
+	// login session of consent request, only sent with consent request
+	LoginSessionId string `json:"login_session_id"`
+	// context set when accepting login request, only sent with consent request
+	Context json.RawMessage `json:"context"`
+}
+
+// LoginContext is passed from login step to consent step through hydra
+type LoginContext struct {
+	// client which user logged in, claims and roles are only valid for it
+	ClientId string `json:"client_id,omitempty"`
+	// claims collected at login time when they cannot be searched during
+	// consent step
+	Claims *Claim `json:"claims,omitempty"`
+	// DN of user entry found at login time
+	DN string `json:"dn,omitempty"`
+	// ldap endpoint which authenticated user
+	Directory string `json:"directory,omitempty"`
+	// authentication method reference (eg. `pwd`)
+	AuthMethod string `json:"auth_method,omitempty"`
+	// unix time of authentication
+	AuthTime int64 `json:"auth_time,omitempty"`
+	// ip address of user at login time
+	SourceIP string `json:"source_ip,omitempty"`
+	// signature of other fields set when login request is accepted
+	Signature string `json:"signature,omitempty"`
+}
+
+// LoginContext decodes context set when login request was accepted
+func (r *HydraResp) LoginContext() (*LoginContext, error) {
+	var loginCtx LoginContext
+	if len(r.Context) == 0 || string(r.Context) == "null" {
+		return &loginCtx, nil
+	}
+	if err := json.Unmarshal(r.Context, &loginCtx); err != nil {
+		return nil, errors.Wrap(err, "while decoding login context")
+	}
+	return &loginCtx, nil
+}
+
+// LogoutResp contains logout request from Hydra
+type LogoutResp struct {
+	Challenge   string `json:"challenge"`
+	Subject     string `json:"subject"`
+	SessionId   string `json:"sid"`
+	RequestURL  string `json:"request_url"`
+	RpInitiated bool   `json:"rp_initiated"`
 }
 
 type reqType string
@@ -35,10 +90,12 @@ type reqVerb string
 const (
 	LOGIN_REQ   reqType = "login"
 	CONSENT_REQ reqType = "consent"
+	LOGOUT_REQ  reqType = "logout"
 )
 
 const (
 	ACCEPT_VERB reqVerb = "/accept"
+	REJECT_VERB reqVerb = "/reject"
 	GET_VERB    reqVerb = ""
 )
 
@@ -46,6 +103,8 @@ type reqInfo struct {
 	reqType
 	reqVerb
 	challenge string
+	// admin api path prefix depending on hydra version
+	prefix string
 }
 
 type HttpClient struct {
@@ -64,6 +123,14 @@ func (client *HttpClient) GetContext() context.Context {
 	return client.Ctx
 }
 
+func (client *HttpClient) do(r *http.Request) (*http.Response, error) {
+	if client.Cfg.transport == nil {
+		// config was not validated
+		return http.DefaultClient.Do(r)
+	}
+	return client.Cfg.transport.do(r)
+}
+
 func (client *HttpClient) Delete(u *url.URL) (*http.Response, error) {
 	fullUrl := client.Cfg.ParsedUrl().ResolveReference(u)
 	r, err := http.NewRequestWithContext(client.GetContext(), http.MethodDelete, fullUrl.String(), nil)
@@ -71,7 +138,7 @@ func (client *HttpClient) Delete(u *url.URL) (*http.Response, error) {
 		return nil, err
 	}
 
-	return http.DefaultClient.Do(r)
+	return client.do(r)
 }
 
 func (client *HttpClient) Get(u *url.URL) (*http.Response, error) {
@@ -81,28 +148,34 @@ func (client *HttpClient) Get(u *url.URL) (*http.Response, error) {
 		return nil, err
 	}
 
-	return http.DefaultClient.Do(r)
+	return client.do(r)
 }
 
 func (client *HttpClient) PutJSON(u *url.URL, body io.Reader) (*http.Response, error) {
 	fullUrl := client.Cfg.ParsedUrl().ResolveReference(u)
-	r, err := http.NewRequestWithContext(client.GetContext(), http.MethodPut, fullUrl.String(), body)
+	// body is read once so that request can be sent again on retry
+	content, err := bodyBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(client.GetContext(), http.MethodPut, fullUrl.String(), content)
 	if err != nil {
 		return nil, err
 	}
 	r.Header.Set("Content-Type", "application/json")
-	return http.DefaultClient.Do(r)
+	return client.do(r)
 }
 
 func call(c HttpClientInterface, info *reqInfo, jsonReq interface{}, jsonResp interface{}) error {
-	urlPath := fmt.Sprintf("oauth2/auth/requests/%[1]s%[2]s?%[1]s_challenge=%[3]s",
+	urlPath := fmt.Sprintf("%[4]soauth2/auth/requests/%[1]s%[2]s?%[1]s_challenge=%[3]s",
 		info.reqType,
 		info.reqVerb,
 		info.challenge,
+		info.prefix,
 	)
 	ref, err := url.Parse(urlPath)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "while parsing url")
 	}
 	var (
 		resp    *http.Response
@@ -111,7 +184,7 @@ func call(c HttpClientInterface, info *reqInfo, jsonReq interface{}, jsonResp in
 	if jsonReq != nil {
 		buf := new(bytes.Buffer)
 		if err := json.NewEncoder(buf).Encode(jsonReq); err != nil {
-			return err
+			return errors.Wrap(err, "while encoding request body")
 		}
 		if logging.Logger.GetLevel() <= zerolog.DebugLevel {
 			// convert buf into string only if necessary
@@ -123,13 +196,17 @@ func call(c HttpClientInterface, info *reqInfo, jsonReq interface{}, jsonResp in
 		resp, httperr = c.Get(ref)
 	}
 
-	defer resp.Body.Close()
 	if httperr != nil {
 		return errors.Wrap(httperr, "http request to hydra failed")
 	}
+	defer resp.Body.Close()
 	if err = checkResponse(resp); err != nil {
 		return errors.Wrap(err, "hydra reply with error")
 	}
+	if resp.StatusCode == http.StatusNoContent {
+		// hydra replies without body (eg. when rejecting logout request)
+		return nil
+	}
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(jsonResp); err != nil {
 		return errors.Wrap(err, "parse of response body failed")
@@ -139,26 +216,87 @@ func call(c HttpClientInterface, info *reqInfo, jsonReq interface{}, jsonResp in
 
 func getRequest(ctx context.Context, cfg *Config, info *reqInfo) (*HydraResp, error) {
 	var hr HydraResp
-	client := &HttpClient{cfg, ctx}
-	info.reqVerb = GET_VERB
-	if err := call(client, info, nil, &hr); err != nil {
+	if err := fetchRequest(ctx, cfg, info, &hr); err != nil {
 		return nil, err
 	}
 	return &hr, nil
 }
 
+func fetchRequest(ctx context.Context, cfg *Config, info *reqInfo, jsonResp interface{}) error {
+	client := &HttpClient{Cfg: cfg, Ctx: ctx}
+	info.reqVerb = GET_VERB
+	info.prefix = cfg.ApiPrefix()
+	return call(client, info, nil, jsonResp)
+}
+
 func acceptRequest(ctx context.Context, cfg *Config, info *reqInfo, data interface{}) (string, error) {
+	info.reqVerb = ACCEPT_VERB
+	return putRequest(ctx, cfg, info, data)
+}
+
+func rejectRequest(ctx context.Context, cfg *Config, info *reqInfo, reason *RejectReason) (string, error) {
+	info.reqVerb = REJECT_VERB
+	return putRequest(ctx, cfg, info, reason)
+}
+
+func putRequest(ctx context.Context, cfg *Config, info *reqInfo, data interface{}) (string, error) {
 	var rs struct {
 		RedirectTo string `json:"redirect_to"`
 	}
-	client := &HttpClient{cfg, ctx}
-	info.reqVerb = ACCEPT_VERB
+	client := &HttpClient{Cfg: cfg, Ctx: ctx}
+	info.prefix = cfg.ApiPrefix()
 	if err := call(client, info, data, &rs); err != nil {
 		return "", err
 	}
 	return rs.RedirectTo, nil
 }
 
+// Setup watches policy file and detects hydra admin api version when
+// configured as `auto`
+func Setup(cfg *Config) error {
+	cfg.watchPolicies()
+	if cfg.ApiVersion != API_AUTO {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := detectVersion(&HttpClient{Cfg: cfg, Ctx: ctx})
+	if err != nil {
+		return errors.Wrap(err, "while detecting hydra version")
+	}
+	cfg.ApiVersion = version
+	logging.Info().Str("apiversion", version).Msg("hydra api version detected")
+	return nil
+}
+
+func detectVersion(c HttpClientInterface) (string, error) {
+	ref, err := url.Parse("version")
+	if err != nil {
+		return "", errors.Wrap(err, "while parsing url")
+	}
+	resp, err := c.Get(ref)
+	if err != nil {
+		return "", errors.Wrap(err, "http request to hydra failed")
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		return "", errors.Wrap(err, "hydra reply with error")
+	}
+	var rs struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rs); err != nil {
+		return "", errors.Wrap(err, "parse of response body failed")
+	}
+	major := strings.SplitN(strings.TrimPrefix(rs.Version, "v"), ".", 2)[0]
+	switch major {
+	case API_V1, API_V2:
+		return major, nil
+	default:
+		return "", fmt.Errorf("unsupported hydra version %#v", rs.Version)
+	}
+}
+
 func checkResponse(resp *http.Response) error {
 	if resp.StatusCode >= 200 && resp.StatusCode <= 302 {
 		return nil
@@ -186,9 +324,9 @@ func checkResponse(resp *http.Response) error {
 func GenericError(ctx context.Context, body io.ReadCloser) error {
 	l := logging.FromCtx(ctx)
 	var jsonResp struct {
-		Debug            string `json:debug`
-		Error            string `json:error`
-		ErrorDescription string `json:error_description`
+		Debug            string `json:"debug"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
 	}
 	dec := json.NewDecoder(body)
 	if err := dec.Decode(&jsonResp); err != nil {
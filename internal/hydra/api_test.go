@@ -5,8 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,6 +69,154 @@ func TestGetRequest(t *testing.T) {
 	})
 }
 
+func TestRejectRequest(t *testing.T) {
+	info := &reqInfo{
+		challenge: "123",
+		reqType:   CONSENT_REQ,
+		reqVerb:   REJECT_VERB,
+	}
+	ref, err := url.Parse("oauth2/auth/requests/consent/reject?consent_challenge=123")
+	assert.NoError(t, err)
+	reason := &RejectReason{
+		Error:            "access_denied",
+		ErrorDescription: "not allowed",
+		StatusCode:       403,
+	}
+	body := bytes.NewBufferString(`{"error":"access_denied","error_description":"not allowed","status_code":403}` + "\n")
+	client := new(fakeClient)
+	client.On("PutJSON", ref, body).Return(
+		&http.Response{
+			Body:       newClosableBuffer(`{"redirect_to": "https://app.example.com/callback?error=access_denied"}`),
+			StatusCode: 200,
+		},
+		nil,
+	)
+	var rs struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	err = call(client, info, reason, &rs)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/callback?error=access_denied", rs.RedirectTo)
+}
+
+func TestLogoutRequest(t *testing.T) {
+	t.Run("get", func(t *testing.T) {
+		info := &reqInfo{
+			challenge: "123",
+			reqType:   LOGOUT_REQ,
+			reqVerb:   GET_VERB,
+		}
+		ref, err := url.Parse("oauth2/auth/requests/logout?logout_challenge=123")
+		assert.NoError(t, err)
+		client := new(fakeClient)
+		client.On("Get", ref).Return(
+			&http.Response{
+				Body:       newClosableBuffer(`{"subject": "jdupont", "sid": "abc", "rp_initiated": true}`),
+				StatusCode: 200,
+			},
+			nil,
+		)
+		var lr LogoutResp
+		err = call(client, info, nil, &lr)
+		assert.NoError(t, err)
+		assert.Equal(t, LogoutResp{Subject: "jdupont", SessionId: "abc", RpInitiated: true}, lr)
+	})
+
+	t.Run("reject without body", func(t *testing.T) {
+		info := &reqInfo{
+			challenge: "123",
+			reqType:   LOGOUT_REQ,
+			reqVerb:   REJECT_VERB,
+		}
+		ref, err := url.Parse("oauth2/auth/requests/logout/reject?logout_challenge=123")
+		assert.NoError(t, err)
+		body := bytes.NewBufferString(`{"error":"access_denied"}` + "\n")
+		client := new(fakeClient)
+		client.On("PutJSON", ref, body).Return(
+			&http.Response{
+				Body:       newClosableBuffer(""),
+				StatusCode: 204,
+			},
+			nil,
+		)
+		var rs struct {
+			RedirectTo string `json:"redirect_to"`
+		}
+		err = call(client, info, &RejectReason{Error: "access_denied"}, &rs)
+		assert.NoError(t, err)
+		assert.Equal(t, "", rs.RedirectTo)
+	})
+}
+
+func TestApiVersions(t *testing.T) {
+	for version, prefix := range map[string]string{"v1": "", "v2": "admin/"} {
+		t.Run(version, func(t *testing.T) {
+			info := &reqInfo{
+				challenge: "123",
+				reqType:   LOGIN_REQ,
+				reqVerb:   GET_VERB,
+				prefix:    prefix,
+			}
+			ref, err := url.Parse(prefix + "oauth2/auth/requests/login?login_challenge=123")
+			assert.NoError(t, err)
+			client := new(fakeClient)
+			client.On("Get", ref).Return(
+				&http.Response{
+					Body:       newRecordedBody(t, version, "login_request.json"),
+					StatusCode: 200,
+				},
+				nil,
+			)
+			var hr HydraResp
+			err = call(client, info, nil, &hr)
+			assert.NoError(t, err)
+			assert.Equal(t, "4b8ab2e8c6bf4fa0a8f5b4a4b4d1e9f0", hr.Challenge)
+			assert.Equal(t, []string{"openid", "profile"}, hr.RequestedScopes)
+			assert.Equal(t, "wiki", hr.Client.Id)
+			assert.Equal(t, "Wiki", hr.Client.Name)
+			assert.Equal(t, "5a1b7e55-5c1b-4d2b-9d9a-2f6c0f4e6a11", hr.SessionId)
+		})
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	ref, err := url.Parse("version")
+	assert.NoError(t, err)
+	for expected, version := range map[string]string{API_V1: "v1", API_V2: "v2"} {
+		client := new(fakeClient)
+		client.On("Get", ref).Return(
+			&http.Response{
+				Body:       newRecordedBody(t, version, "version.json"),
+				StatusCode: 200,
+			},
+			nil,
+		)
+		detected, err := detectVersion(client)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, detected)
+	}
+
+	client := new(fakeClient)
+	client.On("Get", ref).Return(
+		&http.Response{
+			Body:       newClosableBuffer(`{"version": "v3.0.0"}`),
+			StatusCode: 200,
+		},
+		nil,
+	)
+	_, err = detectVersion(client)
+	assert.Error(t, err)
+}
+
+// newRecordedBody returns response recorded from hydra `version`
+func newRecordedBody(t *testing.T, version, name string) *closableBuffer {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", version, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClosableBuffer(string(content))
+}
+
 type closableBuffer struct {
 	*bytes.Buffer
 }
@@ -0,0 +1,154 @@
+package hydra
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// AuthConfig configures credentials and tls used to reach hydra admin api,
+// eg. when it is exposed behind a gateway
+type AuthConfig struct {
+	// file containing a bearer token, read again at each request so that it
+	// can be rotated
+	TokenFile string
+	// basic auth credentials
+	Username string
+	Password string
+	// oauth2 client credentials flow against another issuer
+	ClientCredentials ClientCredentialsConfig
+	// pem file of certificate authorities trusted to verify hydra
+	// certificate (default to system ones)
+	CaFile string
+	// pem files of client certificate and its key for mutual tls
+	CertFile string
+	KeyFile  string
+	// path of a unix socket used instead of tcp connection, hydra url is
+	// still used to build requests
+	Socket string
+}
+
+type ClientCredentialsConfig struct {
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+}
+
+func (c *AuthConfig) Validate() error {
+	methods := 0
+	if c.TokenFile != "" {
+		methods++
+	}
+	if c.Username != "" {
+		methods++
+	}
+	if c.ClientCredentials.TokenUrl != "" {
+		methods++
+		if c.ClientCredentials.ClientId == "" {
+			return fmt.Errorf("client credentials need a client id")
+		}
+	}
+	if methods > 1 {
+		return fmt.Errorf("only one of token file, basic auth or client credentials can be used")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("client certificate needs both cert file and key file")
+	}
+	return nil
+}
+
+func (c *AuthConfig) tlsConfig() (*tls.Config, error) {
+	if c.CaFile == "" && c.CertFile == "" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{}
+	if c.CaFile != "" {
+		content, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in ca file %#v", c.CaFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading client certificate")
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// dialer returns function establishing connections to hydra, through unix
+// socket when configured
+func (c *AuthConfig) dialer(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Socket == "" {
+		return d.DialContext
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", c.Socket)
+	}
+}
+
+// roundTripper adds credentials to requests sent by `base`
+func (c *AuthConfig) roundTripper(base http.RoundTripper) http.RoundTripper {
+	switch {
+	case c.TokenFile != "":
+		return &authTransport{base: base, authorize: c.bearerToken}
+	case c.Username != "":
+		return &authTransport{base: base, authorize: c.basicAuth}
+	case c.ClientCredentials.TokenUrl != "":
+		cc := &clientcredentials.Config{
+			ClientID:     c.ClientCredentials.ClientId,
+			ClientSecret: c.ClientCredentials.ClientSecret,
+			TokenURL:     c.ClientCredentials.TokenUrl,
+			Scopes:       c.ClientCredentials.Scopes,
+		}
+		// tokens are cached and renewed when expired
+		return &oauth2.Transport{Source: cc.TokenSource(context.Background()), Base: base}
+	default:
+		return base
+	}
+}
+
+func (c *AuthConfig) bearerToken(r *http.Request) error {
+	content, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return errors.Wrap(err, "while reading token file")
+	}
+	r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(content)))
+	return nil
+}
+
+func (c *AuthConfig) basicAuth(r *http.Request) error {
+	r.SetBasicAuth(c.Username, c.Password)
+	return nil
+}
+
+type authTransport struct {
+	base      http.RoundTripper
+	authorize func(r *http.Request) error
+}
+
+func (t *authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify original request
+	r = r.Clone(r.Context())
+	if err := t.authorize(r); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,91 @@
+package hydra
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthValidate(t *testing.T) {
+	assert.NoError(t, (&AuthConfig{}).Validate())
+	assert.NoError(t, (&AuthConfig{Username: "admin", Password: "secret"}).Validate())
+	assert.Error(t, (&AuthConfig{Username: "admin", TokenFile: "/token"}).Validate())
+	assert.Error(t, (&AuthConfig{ClientCredentials: ClientCredentialsConfig{TokenUrl: "https://issuer/token"}}).Validate())
+	assert.Error(t, (&AuthConfig{CertFile: "client.pem"}).Validate())
+}
+
+func TestAuthCredentials(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hydra-auth")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	send := func(auth *AuthConfig) {
+		cfg := &HttpConfig{Retries: -1, BreakerThreshold: -1}
+		cfg.Validate()
+		tr, err := newTransport(cfg, auth)
+		assert.NoError(t, err)
+		r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+		_, err = tr.do(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "", r.Header.Get("Authorization"))
+	}
+
+	t.Run("token file", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("abc\n"), 0600))
+		send(&AuthConfig{TokenFile: tokenFile})
+		assert.Equal(t, "Bearer abc", authorization)
+
+		// token is read again after rotation
+		assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("def\n"), 0600))
+		send(&AuthConfig{TokenFile: tokenFile})
+		assert.Equal(t, "Bearer def", authorization)
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		send(&AuthConfig{Username: "admin", Password: "secret"})
+		assert.Equal(t, "Basic YWRtaW46c2VjcmV0", authorization)
+	})
+}
+
+func TestAuthSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-socket")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "hydra.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// request sent to a proxy has absolute uri
+		w.Write([]byte(r.RequestURI))
+	}))
+	srv.Listener = listener
+	srv.Start()
+	defer srv.Close()
+
+	// proxy must not be used to reach hydra through socket
+	os.Setenv("HTTP_PROXY", "http://proxy.invalid:3128")
+	defer os.Unsetenv("HTTP_PROXY")
+	cfg := &HttpConfig{}
+	cfg.Validate()
+	tr, err := newTransport(cfg, &AuthConfig{Socket: socket})
+	assert.NoError(t, err)
+	r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://hydra/version", nil)
+	resp, err := tr.do(r)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "/version", string(body))
+}
@@ -2,17 +2,123 @@ package hydra
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
+const (
+	API_V1 = "1"
+	API_V2 = "2"
+	// detect api version from hydra `/version` endpoint at startup
+	API_AUTO = "auto"
+)
+
+// classes of errors which can be reported to the client through hydra
+const (
+	// user is not allowed to access the app
+	UNAUTHORIZED_ERR = "unauthorized"
+	// directory did not respond in time
+	UNAVAILABLE_ERR = "unavailable"
+	// any other error
+	INTERNAL_ERR = "internal"
+)
+
+// descriptions and hints sent to the client, they must not reveal which
+// account tried to login
+var errClassDescription = map[string]string{
+	UNAUTHORIZED_ERR: "The user is not allowed to access this application.",
+	UNAVAILABLE_ERR:  "The user directory is temporarily unavailable.",
+	INTERNAL_ERR:     "The user could not be authenticated.",
+}
+
+var errClassHint = map[string]string{
+	UNAUTHORIZED_ERR: "Ask an administrator to grant access to this application.",
+	UNAVAILABLE_ERR:  "Retry later.",
+	INTERNAL_ERR:     "Contact an administrator if the problem persists.",
+}
+
+var errClassStatus = map[string]int{
+	UNAUTHORIZED_ERR: http.StatusForbidden,
+	UNAVAILABLE_ERR:  http.StatusServiceUnavailable,
+	INTERNAL_ERR:     http.StatusInternalServerError,
+}
+
+// oauth2 and openid connect error codes
+var oauthErrors = []string{
+	"access_denied",
+	"login_required",
+	"consent_required",
+	"interaction_required",
+	"account_selection_required",
+	"temporarily_unavailable",
+	"server_error",
+}
+
 type Config struct {
 	Url         string
 	SessionTTL  time.Duration
 	ClaimScopes []string
+	// per-client overrides of ClaimScopes, as `clientid:claim:scope`
+	// strings, an overridden claim is only released with scopes of its
+	// overrides
+	ClientClaimScopes []string
+	// version of hydra admin api: 1 (default), 2 or auto
+	ApiVersion string
+	// number of consent sessions asked per request to hydra (default 100)
+	SessionsPageSize int
+	// maximum number of consent sessions read for a user, following pages
+	// are ignored (default 1000)
+	MaxSessions int
+	// error classes reported to the client by rejecting request through
+	// hydra instead of rendering a local page, as `class:oauth2_error`
+	// strings
+	RejectErrors []string
+	// ask user to confirm logout requested by a client, listing apps
+	// user will be logged out of
+	LogoutConfirm bool
+	// ids of first-party clients for which consent is given without asking
+	// user
+	TrustedClients []string
+	// scopes user cannot deselect on consent page, as `clientid:scope`
+	// strings where clientid can be `*` for any client (`openid` is always
+	// mandatory)
+	MandatoryScopes []string
+	// token where claims are put, as `clientid:claim:target` strings where
+	// target is `id_token` (default), `access_token` or `both` and clientid
+	// can be `*` for any client
+	ClaimTargets []string
+	// minimum acr required by clients, as `clientid:acr` strings
+	MinAcr []string
+	// secret signing context passed from login step to consent step, should
+	// be shared by all instances (random if empty)
+	ContextSecret string
+	// file of per-client policies, reloaded when it changes
+	PolicyFile string
+	// http client used to call hydra admin api
+	Http HttpConfig
+	// credentials and tls settings of hydra admin api
+	Auth AuthConfig
+
+	transport   *transport
+	policies    *policyRegistry
+	policyViper *viper.Viper
+	// oauth2 error by error class, parsed from RejectErrors
+	rejectErrors map[string]string
+	// minimum acr by client id, parsed from MinAcr
+	minAcr map[string]string
+	// target of claims by client id, parsed from ClaimTargets
+	claimTargets map[string]map[string]string
+	// mandatory scopes by client id, parsed from MandatoryScopes
+	mandatoryScopes map[string][]string
+	// claims by scope, parsed from ClaimScopes
+	claimScopes map[string][]string
+	// scopes by claim by client id, parsed from ClientClaimScopes
+	clientOverrides map[string]map[string][]string
 }
 
 func (c *Config) ParsedUrl() *url.URL {
@@ -38,8 +144,125 @@ func (c *Config) ParsedClaimScopes() (map[string][]string, error) {
 	return result, nil
 }
 
-func (c *Config) RememberFor() int {
-	return int(c.SessionTTL.Seconds())
+func (c *Config) parsedClientClaimScopes() (map[string]map[string][]string, error) {
+	result := make(map[string]map[string][]string)
+	for _, clientClaimScope := range c.ClientClaimScopes {
+		splitted := strings.Split(clientClaimScope, ":")
+		if len(splitted) != 3 {
+			return nil, fmt.Errorf(
+				"one client claim scope is not well formatted %#v (should contain exactly two `:`)",
+				clientClaimScope)
+		}
+		clientId, claim, scope := splitted[0], splitted[1], splitted[2]
+		if result[clientId] == nil {
+			result[clientId] = make(map[string][]string)
+		}
+		result[clientId][claim] = append(result[clientId][claim], scope)
+	}
+	return result, nil
+}
+
+// clientClaimScopes returns claims of each scope for client, global claim
+// scopes merged with overrides of client
+func (c *Config) clientClaimScopes(clientId string) map[string][]string {
+	overrides := c.clientOverrides[clientId]
+	if len(overrides) == 0 {
+		return c.claimScopes
+	}
+	result := make(map[string][]string)
+	for scope, claims := range c.claimScopes {
+		for _, claim := range claims {
+			if _, ok := overrides[claim]; !ok {
+				result[scope] = append(result[scope], claim)
+			}
+		}
+	}
+	for claim, scopes := range overrides {
+		for _, scope := range scopes {
+			result[scope] = append(result[scope], claim)
+		}
+	}
+	return result
+}
+
+// ClientClaims returns claims overridden for each client
+func (c *Config) ClientClaims() map[string][]string {
+	result := make(map[string][]string)
+	for clientId, claimScopes := range c.clientOverrides {
+		for claim := range claimScopes {
+			result[clientId] = append(result[clientId], claim)
+		}
+	}
+	return result
+}
+
+// ApiPrefix returns path prefix of admin api routes
+func (c *Config) ApiPrefix() string {
+	if c.ApiVersion == API_V2 {
+		return "admin/"
+	}
+	return ""
+}
+
+// SessionRevocable tells if a single login session can be revoked, which is
+// only supported by hydra 2.x
+func (c *Config) SessionRevocable() bool {
+	return c.ApiVersion == API_V2
+}
+
+func (c *Config) parsedRejectErrors() (map[string]string, error) {
+	result := make(map[string]string)
+	for _, rejectError := range c.RejectErrors {
+		splitted := strings.Split(rejectError, ":")
+		if len(splitted) != 2 {
+			return nil, fmt.Errorf(
+				"one reject error is not well formatted %#v (should contain exactly one `:`)",
+				rejectError)
+		}
+		class, oauthError := splitted[0], splitted[1]
+		if _, ok := errClassStatus[class]; !ok {
+			return nil, fmt.Errorf("unknown error class %#v", class)
+		}
+		if !contains(oauthErrors, oauthError) {
+			return nil, fmt.Errorf("unknown oauth2 error %#v", oauthError)
+		}
+		result[class] = oauthError
+	}
+	return result, nil
+}
+
+// RejectReason returns reason sent to hydra for error `class`, or nil if
+// this error should be rendered locally
+func (c *Config) RejectReason(class string) *RejectReason {
+	oauthError, ok := c.rejectErrors[class]
+	if !ok {
+		return nil
+	}
+	return &RejectReason{
+		Error:            oauthError,
+		ErrorDescription: errClassDescription[class],
+		ErrorHint:        errClassHint[class],
+		StatusCode:       errClassStatus[class],
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Trusted tells if consent to `client` is given without asking user, either
+// from config or from `metadata.trusted`/`skip_consent` of hydra client
+func (c *Config) Trusted(client ClientInfo) bool {
+	if contains(c.TrustedClients, client.Id) || client.SkipConsent {
+		return true
+	}
+	trusted, _ := client.Metadata["trusted"].(bool)
+	return trusted
 }
 
 func (c *Config) Validate() error {
@@ -50,7 +273,53 @@ func (c *Config) Validate() error {
 		c.Url += "/"
 	}
 	c.ParsedUrl()
-	if _, err := c.ParsedClaimScopes(); err != nil {
+	if err := c.validateContextSecret(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	c.Http.Validate()
+	if err := c.Auth.Validate(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	transport, err := newTransport(&c.Http, &c.Auth)
+	if err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	c.transport = transport
+	switch c.ApiVersion {
+	case "":
+		c.ApiVersion = API_V1
+	case API_V1, API_V2, API_AUTO:
+	default:
+		return fmt.Errorf("unknown hydra api version %#v", c.ApiVersion)
+	}
+	if c.SessionsPageSize == 0 {
+		c.SessionsPageSize = 100
+	}
+	if c.MaxSessions == 0 {
+		c.MaxSessions = 1000
+	}
+	if c.SessionsPageSize < 0 || c.MaxSessions < 0 {
+		return fmt.Errorf("negative sessions page size or maximum")
+	}
+	if c.claimScopes, err = c.ParsedClaimScopes(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if c.clientOverrides, err = c.parsedClientClaimScopes(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if c.rejectErrors, err = c.parsedRejectErrors(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if c.mandatoryScopes, err = c.parsedMandatoryScopes(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if c.claimTargets, err = c.parsedClaimTargets(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if c.minAcr, err = c.parsedMinAcr(); err != nil {
+		return errors.Wrap(err, "while validating Hydra.Config")
+	}
+	if err := c.loadPolicies(); err != nil {
 		return errors.Wrap(err, "while validating Hydra.Config")
 	}
 	return nil
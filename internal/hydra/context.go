@@ -0,0 +1,96 @@
+package hydra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// ErrContextSignature happens when login context was not signed by this
+// server (or with another secret)
+var ErrContextSignature = errors.New("invalid login context signature")
+
+// MIN_CONTEXT_SECRET is the minimum length of configured context secret
+const MIN_CONTEXT_SECRET = 32
+
+// validateContextSecret rejects a short secret and generates one when none is
+// configured
+func (c *Config) validateContextSecret() error {
+	if c.ContextSecret == "" {
+		logging.Warn().Msg("no hydra context secret configured, a random one is generated: " +
+			"login contexts cannot be verified by other instances nor after restart")
+	} else if len(c.ContextSecret) < MIN_CONTEXT_SECRET {
+		return fmt.Errorf("hydra context secret should be at least %d characters long", MIN_CONTEXT_SECRET)
+	}
+	c.contextSecret()
+	return nil
+}
+
+// contextSecret returns key signing login contexts, a random one is
+// generated when none is configured (contexts are then only valid for this
+// process)
+func (c *Config) contextSecret() []byte {
+	if c.ContextSecret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic("cannot generate login context secret")
+		}
+		c.ContextSecret = base64.StdEncoding.EncodeToString(secret)
+	}
+	return []byte(c.ContextSecret)
+}
+
+func (l *LoginContext) signature(secret []byte) (string, error) {
+	unsigned := *l
+	unsigned.Signature = ""
+	content, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", errors.Wrap(err, "while encoding login context")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(content)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (l *LoginContext) sign(secret []byte) error {
+	signature, err := l.signature(secret)
+	if err != nil {
+		return err
+	}
+	l.Signature = signature
+	return nil
+}
+
+func (l *LoginContext) verify(secret []byte) error {
+	expected, err := l.signature(secret)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(l.Signature)) {
+		return ErrContextSignature
+	}
+	return nil
+}
+
+// LoginContext decodes and verifies context set when login request of `resp`
+// was accepted, an empty context is returned if none was set
+func (c *Config) LoginContext(resp *HydraResp) (*LoginContext, error) {
+	loginCtx, err := resp.LoginContext()
+	if err != nil {
+		return nil, err
+	}
+	if *loginCtx == (LoginContext{}) {
+		return loginCtx, nil
+	}
+	if err := loginCtx.verify(c.contextSecret()); err != nil {
+		return nil, err
+	}
+	return loginCtx, nil
+}
@@ -0,0 +1,85 @@
+package hydra
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedLoginContext(t *testing.T) {
+	cfg := Config{Url: "http://localhost:4445", ContextSecret: "0123456789abcdef0123456789abcdef"}
+	assert.NoError(t, cfg.Validate())
+
+	loginCtx := &LoginContext{
+		Claims: &Claim{
+			Details: map[string]interface{}{"email": "joe@example.com"},
+			Roles:   []string{"admin"},
+		},
+		ClientId:   "wiki",
+		DN:         "uid=joe,ou=users,dc=example,dc=com",
+		Directory:  "ldap1.example.com:389",
+		AuthMethod: AMR_PASSWORD,
+		AuthTime:   1586000000,
+		SourceIP:   "192.0.2.1",
+	}
+	assert.NoError(t, loginCtx.sign(cfg.contextSecret()))
+	raw, err := json.Marshal(loginCtx)
+	assert.NoError(t, err)
+
+	t.Run("valid signature", func(t *testing.T) {
+		decoded, err := cfg.LoginContext(&HydraResp{Context: raw})
+		assert.NoError(t, err)
+		assert.Equal(t, loginCtx, decoded)
+	})
+
+	t.Run("tampered context", func(t *testing.T) {
+		var tampered LoginContext
+		assert.NoError(t, json.Unmarshal(raw, &tampered))
+		tampered.DN = "uid=admin,ou=users,dc=example,dc=com"
+		tamperedRaw, err := json.Marshal(&tampered)
+		assert.NoError(t, err)
+		_, err = cfg.LoginContext(&HydraResp{Context: tamperedRaw})
+		assert.Equal(t, ErrContextSignature, err)
+	})
+
+	t.Run("other secret", func(t *testing.T) {
+		other := Config{Url: "http://localhost:4445", ContextSecret: "fedcba9876543210fedcba9876543210"}
+		assert.NoError(t, other.Validate())
+		_, err := other.LoginContext(&HydraResp{Context: raw})
+		assert.Equal(t, ErrContextSignature, err)
+	})
+
+	t.Run("typed claims", func(t *testing.T) {
+		typed := &LoginContext{Claims: &Claim{Details: map[string]interface{}{
+			"email_verified": true,
+			"updated_at":     int64(1585901560),
+			"address":        map[string]interface{}{"locality": "Paris"},
+		}}}
+		assert.NoError(t, typed.sign(cfg.contextSecret()))
+		typedRaw, err := json.Marshal(typed)
+		assert.NoError(t, err)
+		decoded, err := cfg.LoginContext(&HydraResp{Context: typedRaw})
+		assert.NoError(t, err)
+		// numbers are decoded as float64 but keep their json encoding
+		expected, _ := json.Marshal(typed.Claims.prepareMarshal())
+		actual, _ := json.Marshal(decoded.Claims.prepareMarshal())
+		assert.JSONEq(t, string(expected), string(actual))
+	})
+
+	t.Run("no context", func(t *testing.T) {
+		decoded, err := cfg.LoginContext(&HydraResp{})
+		assert.NoError(t, err)
+		assert.Equal(t, &LoginContext{}, decoded)
+	})
+}
+
+func TestContextSecretLength(t *testing.T) {
+	cfg := Config{Url: "http://localhost:4445", ContextSecret: "change-me"}
+	assert.Error(t, cfg.Validate())
+
+	// a random secret is generated when none is configured
+	cfg.ContextSecret = ""
+	assert.NoError(t, cfg.Validate())
+	assert.True(t, len(cfg.ContextSecret) >= MIN_CONTEXT_SECRET)
+}
@@ -15,11 +15,36 @@ var (
 	ErrChallengeNotFound = errors.New("challenge not found")
 	// ErrChallengeExpired is an error that happens when a challenge is already used.
 	ErrChallengeExpired = errors.New("challenge expired")
+	// ErrUnavailable is an error that happens when hydra failed too many
+	// times and is not called until a cooldown is elapsed.
+	ErrUnavailable = errors.New("hydra unavailable")
 )
 
+// RejectReason is sent to hydra when rejecting a login or consent request,
+// hydra then redirects user to the client with this error
+type RejectReason struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorHint        string `json:"error_hint,omitempty"`
+	StatusCode       int    `json:"status_code,omitempty"`
+}
+
+// ROLES_CLAIM is the default name of the claim holding roles of user
+const ROLES_CLAIM = "roles"
+
 type Claim struct {
-	Details map[string]string
-	Roles   []string
+	// typed claim values, structured claims (eg. `address`) are objects
+	Details map[string]interface{} `json:"details"`
+	Roles   []string               `json:"roles"`
+	// name of roles claim when overridden for a client
+	RolesClaim string `json:"roles_claim,omitempty"`
+}
+
+func (c *Claim) rolesClaim() string {
+	if c.RolesClaim == "" {
+		return ROLES_CLAIM
+	}
+	return c.RolesClaim
 }
 
 func (c *Claim) prepareMarshal() map[string]interface{} {
@@ -28,7 +53,7 @@ func (c *Claim) prepareMarshal() map[string]interface{} {
 		result[k] = v
 	}
 	if c.Roles != nil {
-		result["roles"] = c.Roles
+		result[c.rolesClaim()] = c.Roles
 	}
 	return result
 }
@@ -41,18 +66,30 @@ func GetLoginRequest(ctx context.Context, cfg *Config, challenge string) (*Hydra
 	return resp, nil
 }
 
-func AcceptLoginRequest(ctx context.Context, cfg *Config, remember bool, subject, challenge string) (string, error) {
+func AcceptLoginRequest(ctx context.Context, cfg *Config, clientId string, remember bool, subject, challenge, acr string, amr []string, loginCtx *LoginContext) (string, error) {
 	if challenge == "" {
 		return "", ErrChallengeMissed
 	}
+	if loginCtx != nil {
+		if err := loginCtx.sign(cfg.contextSecret()); err != nil {
+			return "", err
+		}
+	}
+	policy := cfg.Policy(clientId)
 	data := struct {
-		Remember    bool   `json:"remember"`
-		RememberFor int    `json:"remember_for"`
-		Subject     string `json:"subject"`
+		Remember    bool          `json:"remember"`
+		RememberFor int           `json:"remember_for"`
+		Subject     string        `json:"subject"`
+		Acr         string        `json:"acr,omitempty"`
+		Amr         []string      `json:"amr,omitempty"`
+		Context     *LoginContext `json:"context,omitempty"`
 	}{
-		Remember:    remember,
-		RememberFor: cfg.RememberFor(),
+		Remember:    remember && !policy.NeverRemember,
+		RememberFor: policy.loginRememberFor(),
 		Subject:     subject,
+		Acr:         acr,
+		Amr:         amr,
+		Context:     loginCtx,
 	}
 	redirectURL, err := acceptRequest(ctx, cfg, &reqInfo{reqType: LOGIN_REQ, challenge: challenge}, data)
 	if err != nil {
@@ -61,6 +98,17 @@ func AcceptLoginRequest(ctx context.Context, cfg *Config, remember bool, subject
 	return redirectURL, nil
 }
 
+func RejectLoginRequest(ctx context.Context, cfg *Config, challenge string, reason *RejectReason) (string, error) {
+	if challenge == "" {
+		return "", ErrChallengeMissed
+	}
+	redirectURL, err := rejectRequest(ctx, cfg, &reqInfo{reqType: LOGIN_REQ, challenge: challenge}, reason)
+	if err != nil {
+		return "", err
+	}
+	return redirectURL, nil
+}
+
 func GetConsentRequest(ctx context.Context, cfg *Config, challenge string) (*HydraResp, error) {
 	resp, err := getRequest(ctx, cfg, &reqInfo{reqType: CONSENT_REQ, challenge: challenge})
 	if err != nil {
@@ -69,22 +117,20 @@ func GetConsentRequest(ctx context.Context, cfg *Config, challenge string) (*Hyd
 	return resp, nil
 }
 
-func AcceptConsentRequest(ctx context.Context, cfg *Config, challenge string, remember bool, grantScope []string, claims *Claim) (string, error) {
-	type session struct {
-		IDToken interface{} `json:"id_token,omitempty"`
-	}
+func AcceptConsentRequest(ctx context.Context, cfg *Config, clientId, challenge string, remember bool, grantScope, grantAudience []string, session *TokenSession) (string, error) {
+	policy := cfg.Policy(clientId)
 	data := struct {
-		GrantScope  []string `json:"grant_scope"`
-		Remember    bool     `json:"remember"`
-		RememberFor int      `json:"remember_for"`
-		Session     session  `json:"session,omitempty"`
+		GrantScope    []string      `json:"grant_scope"`
+		GrantAudience []string      `json:"grant_access_token_audience,omitempty"`
+		Remember      bool          `json:"remember"`
+		RememberFor   int           `json:"remember_for"`
+		Session       *TokenSession `json:"session,omitempty"`
 	}{
-		GrantScope:  grantScope,
-		Remember:    remember,
-		RememberFor: cfg.RememberFor(),
-		Session: session{
-			IDToken: claims.prepareMarshal(),
-		},
+		GrantScope:    grantScope,
+		GrantAudience: grantAudience,
+		Remember:      remember && !policy.NeverRemember,
+		RememberFor:   policy.consentRememberFor(),
+		Session:       session,
 	}
 	if challenge == "" {
 		return "", ErrChallengeMissed
@@ -96,13 +142,56 @@ func AcceptConsentRequest(ctx context.Context, cfg *Config, challenge string, re
 	return redirectURL, nil
 }
 
-func FilterClaims(cfg *Config, claims *Claim, requestedScopes []string) *Claim {
+func RejectConsentRequest(ctx context.Context, cfg *Config, challenge string, reason *RejectReason) (string, error) {
+	if challenge == "" {
+		return "", ErrChallengeMissed
+	}
+	redirectURL, err := rejectRequest(ctx, cfg, &reqInfo{reqType: CONSENT_REQ, challenge: challenge}, reason)
+	if err != nil {
+		return "", err
+	}
+	return redirectURL, nil
+}
+
+func GetLogoutRequest(ctx context.Context, cfg *Config, challenge string) (*LogoutResp, error) {
+	var resp LogoutResp
+	if err := fetchRequest(ctx, cfg, &reqInfo{reqType: LOGOUT_REQ, challenge: challenge}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func AcceptLogoutRequest(ctx context.Context, cfg *Config, challenge string) (string, error) {
+	if challenge == "" {
+		return "", ErrChallengeMissed
+	}
+	// hydra expects an empty json object
+	redirectURL, err := acceptRequest(ctx, cfg, &reqInfo{reqType: LOGOUT_REQ, challenge: challenge}, struct{}{})
+	if err != nil {
+		return "", err
+	}
+	return redirectURL, nil
+}
+
+// RejectLogoutRequest tells hydra that user did not want to logout, hydra
+// does not give any url so user stays on hydra-ldap
+func RejectLogoutRequest(ctx context.Context, cfg *Config, challenge string, reason *RejectReason) error {
+	if challenge == "" {
+		return ErrChallengeMissed
+	}
+	_, err := rejectRequest(ctx, cfg, &reqInfo{reqType: LOGOUT_REQ, challenge: challenge}, reason)
+	return err
+}
+
+// FilterClaims keeps claims of granted scopes, according to claim scopes of
+// client
+func FilterClaims(cfg *Config, clientId string, claims *Claim, grantedScopes []string) *Claim {
 	result := &Claim{
-		Details: make(map[string]string, len(claims.Details)),
+		Details:    make(map[string]interface{}, len(claims.Details)),
+		RolesClaim: claims.RolesClaim,
 	}
-	// ignore error as it should alreay be handled in Validate
-	scopeClaims, _ := cfg.ParsedClaimScopes()
-	for _, scope := range requestedScopes {
+	scopeClaims := cfg.clientClaimScopes(clientId)
+	for _, scope := range grantedScopes {
 		expectedClaims, ok := scopeClaims[scope]
 		if !ok {
 			continue
@@ -110,7 +199,7 @@ func FilterClaims(cfg *Config, claims *Claim, requestedScopes []string) *Claim {
 		for _, expectedClaim := range expectedClaims {
 			if value, ok := claims.Details[expectedClaim]; ok {
 				result.Details[expectedClaim] = value
-			} else if expectedClaim == "roles" {
+			} else if expectedClaim == claims.rolesClaim() {
 				result.Roles = claims.Roles
 			}
 		}
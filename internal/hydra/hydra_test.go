@@ -1,6 +1,7 @@
 package hydra
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,7 +10,7 @@ import (
 func TestMarshalClaim(t *testing.T) {
 	t.Run("with roles", func(t *testing.T) {
 		c := Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name":  "Joe",
 				"email": "joe@example.com",
 			},
@@ -25,7 +26,7 @@ func TestMarshalClaim(t *testing.T) {
 
 	t.Run("without roles", func(t *testing.T) {
 		c := Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name":  "Joe",
 				"email": "joe@example.com",
 			},
@@ -42,21 +43,23 @@ func TestFilterClaims(t *testing.T) {
 
 	t.Run("one field", func(t *testing.T) {
 		cfg := Config{
+			Url: "http://localhost:4445",
 			ClaimScopes: []string{
 				"name:profile",
 			},
 		}
+		assert.NoError(t, cfg.Validate())
 
 		initialClaims := Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"family_name": "Dupont",
 				"name":        "Jean",
 				"email":       "jean.dupont@example.com",
 			},
 		}
-		result := FilterClaims(&cfg, &initialClaims, []string{"profile"})
+		result := FilterClaims(&cfg, "wiki", &initialClaims, []string{"profile"})
 		expected := &Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name": "Jean",
 			},
 		}
@@ -66,23 +69,25 @@ func TestFilterClaims(t *testing.T) {
 
 	t.Run("profile and email scope", func(t *testing.T) {
 		cfg := Config{
+			Url: "http://localhost:4445",
 			ClaimScopes: []string{
 				"name:profile",
 				"email:email",
 			},
 		}
+		assert.NoError(t, cfg.Validate())
 
 		initialClaims := Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"family_name": "Dupont",
 				"name":        "Jean",
 				"email":       "jean.dupont@example.com",
 			},
 			Roles: []string{"user", "admin"},
 		}
-		result := FilterClaims(&cfg, &initialClaims, []string{"profile", "email"})
+		result := FilterClaims(&cfg, "wiki", &initialClaims, []string{"profile", "email"})
 		expected := &Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name":  "Jean",
 				"email": "jean.dupont@example.com",
 			},
@@ -93,24 +98,26 @@ func TestFilterClaims(t *testing.T) {
 
 	t.Run("profile and email and roles scope", func(t *testing.T) {
 		cfg := Config{
+			Url: "http://localhost:4445",
 			ClaimScopes: []string{
 				"name:profile",
 				"email:email",
 				"roles:roles",
 			},
 		}
+		assert.NoError(t, cfg.Validate())
 
 		initialClaims := Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"family_name": "Dupont",
 				"name":        "Jean",
 				"email":       "jean.dupont@example.com",
 			},
 			Roles: []string{"user", "admin"},
 		}
-		result := FilterClaims(&cfg, &initialClaims, []string{"profile", "email", "roles"})
+		result := FilterClaims(&cfg, "wiki", &initialClaims, []string{"profile", "email", "roles"})
 		expected := &Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name":  "Jean",
 				"email": "jean.dupont@example.com",
 			},
@@ -120,3 +127,118 @@ func TestFilterClaims(t *testing.T) {
 		assert.Equal(t, expected, result)
 	})
 }
+
+func TestFilterClientClaims(t *testing.T) {
+	cfg := Config{
+		Url:         "http://localhost:4445",
+		ClaimScopes: []string{"name:profile", "email:email", "roles:roles"},
+		ClientClaimScopes: []string{
+			"sharepoint:upn:email",
+			"sharepoint:groups:roles",
+			"hr:employee_number:hr",
+			"hr:email:profile",
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	t.Run("renamed claims", func(t *testing.T) {
+		claims := &Claim{
+			Details:    map[string]interface{}{"name": "Jean", "upn": "jdupont@example.com"},
+			Roles:      []string{"admin"},
+			RolesClaim: "groups",
+		}
+		result := FilterClaims(&cfg, "sharepoint", claims, []string{"email", "roles"})
+		expected := &Claim{
+			Details:    map[string]interface{}{"upn": "jdupont@example.com"},
+			Roles:      []string{"admin"},
+			RolesClaim: "groups",
+		}
+		assert.Equal(t, expected, result)
+		assert.Equal(t, map[string]interface{}{
+			"upn":    "jdupont@example.com",
+			"groups": []string{"admin"},
+		}, result.prepareMarshal())
+	})
+
+	t.Run("extra scope and moved claim", func(t *testing.T) {
+		claims := &Claim{
+			Details: map[string]interface{}{
+				"name":            "Jean",
+				"email":           "jean.dupont@example.com",
+				"employee_number": "42",
+			},
+		}
+		result := FilterClaims(&cfg, "hr", claims, []string{"email", "hr"})
+		expected := &Claim{
+			Details: map[string]interface{}{"employee_number": "42"},
+		}
+		assert.Equal(t, expected, result)
+	})
+
+	cfg.ClientClaimScopes = []string{"hr:employee_number"}
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoginContext(t *testing.T) {
+	t.Run("empty context", func(t *testing.T) {
+		for _, raw := range []string{"", "null"} {
+			resp := HydraResp{Context: json.RawMessage(raw)}
+			loginCtx, err := resp.LoginContext()
+			assert.NoError(t, err)
+			assert.Equal(t, &LoginContext{}, loginCtx)
+		}
+	})
+
+	t.Run("with claims", func(t *testing.T) {
+		resp := HydraResp{
+			Context: json.RawMessage(`{"claims": {"details": {"email": "joe@example.com"}, "roles": ["admin"]}}`),
+		}
+		loginCtx, err := resp.LoginContext()
+		assert.NoError(t, err)
+		expected := &LoginContext{
+			Claims: &Claim{
+				Details: map[string]interface{}{"email": "joe@example.com"},
+				Roles:   []string{"admin"},
+			},
+		}
+		assert.Equal(t, expected, loginCtx)
+	})
+}
+
+func TestRejectReason(t *testing.T) {
+	cfg := Config{
+		Url:          "http://localhost:4445",
+		RejectErrors: []string{"unauthorized:access_denied", "unavailable:temporarily_unavailable"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	expected := &RejectReason{
+		Error:            "access_denied",
+		ErrorDescription: "The user is not allowed to access this application.",
+		ErrorHint:        "Ask an administrator to grant access to this application.",
+		StatusCode:       403,
+	}
+	assert.Equal(t, expected, cfg.RejectReason(UNAUTHORIZED_ERR))
+	assert.Nil(t, cfg.RejectReason(INTERNAL_ERR))
+
+	cfg.RejectErrors = []string{"unknown:access_denied"}
+	assert.Error(t, cfg.Validate())
+	cfg.RejectErrors = []string{"unauthorized:denied"}
+	assert.Error(t, cfg.Validate())
+}
+
+func TestTrusted(t *testing.T) {
+	cfg := Config{TrustedClients: []string{"intranet"}}
+	assert.True(t, cfg.Trusted(ClientInfo{Id: "intranet"}))
+	assert.False(t, cfg.Trusted(ClientInfo{Id: "wiki"}))
+	assert.True(t, cfg.Trusted(ClientInfo{Id: "wiki", SkipConsent: true}))
+
+	var client ClientInfo
+	err := json.Unmarshal([]byte(`{"client_id": "wiki", "metadata": {"trusted": true}}`), &client)
+	assert.NoError(t, err)
+	assert.True(t, cfg.Trusted(client))
+
+	err = json.Unmarshal([]byte(`{"client_id": "wiki", "metadata": {"trusted": "yes"}}`), &client)
+	assert.NoError(t, err)
+	assert.False(t, cfg.Trusted(client))
+}
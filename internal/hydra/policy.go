@@ -0,0 +1,177 @@
+package hydra
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// ClientPolicy describes how long login and consent of a client are
+// remembered by hydra
+type ClientPolicy struct {
+	// hydra client id
+	Id string
+	// remember_for of login (default to SessionTTL)
+	LoginRemember time.Duration
+	// remember_for of consent (default to SessionTTL)
+	ConsentRemember time.Duration
+	// consent remembered by hydra is asked again once older than this
+	// interval (0 disables)
+	ReconsentAfter time.Duration
+	// neither login nor consent are remembered
+	NeverRemember bool
+	// scopes which can be granted to client, any if empty
+	MaxScopes []string
+}
+
+// policyFile is the content of policy file, clients are listed rather than
+// mapped as viper lowercases keys
+type policyFile struct {
+	Clients []ClientPolicy
+}
+
+type policyRegistry struct {
+	sync.RWMutex
+	clients map[string]ClientPolicy
+}
+
+func loadPolicies(v *viper.Viper) (map[string]ClientPolicy, error) {
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, "while reading policy file")
+	}
+	var content policyFile
+	if err := v.Unmarshal(&content); err != nil {
+		return nil, errors.Wrap(err, "while decoding policy file")
+	}
+	clients := make(map[string]ClientPolicy, len(content.Clients))
+	for _, policy := range content.Clients {
+		if policy.Id == "" {
+			return nil, fmt.Errorf("client policy without id")
+		}
+		if _, ok := clients[policy.Id]; ok {
+			return nil, fmt.Errorf("several policies for client %#v", policy.Id)
+		}
+		if policy.LoginRemember < 0 || policy.ConsentRemember < 0 || policy.ReconsentAfter < 0 {
+			return nil, fmt.Errorf("negative duration in policy of client %#v", policy.Id)
+		}
+		clients[policy.Id] = policy
+	}
+	return clients, nil
+}
+
+func (c *Config) loadPolicies() error {
+	c.policies = &policyRegistry{}
+	if c.PolicyFile == "" {
+		return nil
+	}
+	c.policyViper = viper.New()
+	c.policyViper.SetConfigFile(c.PolicyFile)
+	clients, err := loadPolicies(c.policyViper)
+	if err != nil {
+		return err
+	}
+	c.policies.clients = clients
+	return nil
+}
+
+// watchPolicies reloads policy file when it changes, an invalid file is
+// reported and previous policies are kept
+func (c *Config) watchPolicies() {
+	if c.policyViper == nil {
+		return
+	}
+	c.policyViper.OnConfigChange(func(e fsnotify.Event) {
+		clients, err := loadPolicies(c.policyViper)
+		if err != nil {
+			logging.Error().Err(err).Str("file", c.PolicyFile).Msg("cannot reload client policies")
+			return
+		}
+		c.policies.Lock()
+		c.policies.clients = clients
+		c.policies.Unlock()
+		logging.Info().Str("file", c.PolicyFile).Int("clients", len(clients)).Msg("client policies reloaded")
+	})
+	c.policyViper.WatchConfig()
+}
+
+// Policy returns policy of client, with defaults from global config
+func (c *Config) Policy(clientId string) ClientPolicy {
+	var policy ClientPolicy
+	if c.policies != nil {
+		c.policies.RLock()
+		policy = c.policies.clients[clientId]
+		c.policies.RUnlock()
+	}
+	policy.Id = clientId
+	if policy.LoginRemember == 0 {
+		policy.LoginRemember = c.SessionTTL
+	}
+	if policy.ConsentRemember == 0 {
+		policy.ConsentRemember = c.SessionTTL
+	}
+	return policy
+}
+
+// MaxLoginRemember returns longest login remember duration among clients, 0
+// when a client remembers login forever
+func (c *Config) MaxLoginRemember() time.Duration {
+	max := c.SessionTTL
+	if c.policies != nil {
+		c.policies.RLock()
+		defer c.policies.RUnlock()
+		for _, policy := range c.policies.clients {
+			if policy.NeverRemember || policy.LoginRemember == 0 {
+				continue
+			}
+			if max != 0 && policy.LoginRemember > max {
+				max = policy.LoginRemember
+			}
+		}
+	}
+	return max
+}
+
+// LoginMaxAge returns age above which remembered login of hydra session is
+// expired for client, as hydra session is shared by all clients. ok is false
+// when no client remembers login longer, hydra expiry is then enough.
+func (c *Config) LoginMaxAge(clientId string) (maxAge time.Duration, ok bool) {
+	remember := c.Policy(clientId).LoginRemember
+	if remember == 0 {
+		return 0, false
+	}
+	if max := c.MaxLoginRemember(); max != 0 && remember >= max {
+		return 0, false
+	}
+	return remember, true
+}
+
+// LoginExpired tells if login authenticated at `authTime` is older than
+// client allows, zero `authTime` means unknown and only hydra expiry applies
+func (c *Config) LoginExpired(clientId string, authTime time.Time) bool {
+	maxAge, ok := c.LoginMaxAge(clientId)
+	if !ok || authTime.IsZero() {
+		return false
+	}
+	return time.Since(authTime) > maxAge
+}
+
+// loginRememberFor returns remember_for of login in seconds
+func (p *ClientPolicy) loginRememberFor() int {
+	return int(p.LoginRemember.Seconds())
+}
+
+// consentRememberFor returns remember_for of consent in seconds
+func (p *ClientPolicy) consentRememberFor() int {
+	return int(p.ConsentRemember.Seconds())
+}
+
+// ScopeAllowed tells if `scope` can be granted to client
+func (p *ClientPolicy) ScopeAllowed(scope string) bool {
+	return len(p.MaxScopes) == 0 || contains(p.MaxScopes, scope)
+}
@@ -0,0 +1,114 @@
+package hydra
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const policies = `
+clients:
+  - id: wiki
+    loginremember: 720h
+    consentremember: 720h
+  - id: Finance
+    loginremember: 24h
+    reconsentafter: 168h
+    maxscopes:
+      - openid
+      - profile
+  - id: kiosk
+    neverremember: true
+`
+
+func writePolicies(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "hydra-policies")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "policies.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestPolicy(t *testing.T) {
+	path := writePolicies(t, policies)
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg := Config{
+		Url:        "http://localhost:4445",
+		SessionTTL: time.Hour,
+		PolicyFile: path,
+	}
+	assert.NoError(t, cfg.Validate())
+
+	wiki := cfg.Policy("wiki")
+	assert.Equal(t, 720*time.Hour, wiki.LoginRemember)
+	assert.Equal(t, 720*time.Hour, wiki.ConsentRemember)
+	assert.True(t, wiki.ScopeAllowed("email"))
+
+	finance := cfg.Policy("Finance")
+	assert.Equal(t, 24*time.Hour, finance.LoginRemember)
+	assert.Equal(t, time.Hour, finance.ConsentRemember)
+	assert.Equal(t, 168*time.Hour, finance.ReconsentAfter)
+	assert.False(t, finance.ScopeAllowed("email"))
+
+	assert.True(t, cfg.Policy("kiosk").NeverRemember)
+	assert.Equal(t, ClientPolicy{Id: "other", LoginRemember: time.Hour, ConsentRemember: time.Hour}, cfg.Policy("other"))
+
+	resp := &HydraResp{
+		RequestedScopes: []string{"openid", "profile", "email"},
+		Client:          ClientInfo{Id: "Finance"},
+	}
+	assert.Equal(t, []string{"openid", "profile"}, cfg.GrantedScopes(resp, resp.RequestedScopes))
+}
+
+func TestLoginExpired(t *testing.T) {
+	path := writePolicies(t, policies)
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg := Config{
+		Url:        "http://localhost:4445",
+		SessionTTL: time.Hour,
+		PolicyFile: path,
+	}
+	assert.NoError(t, cfg.Validate())
+
+	assert.Equal(t, 720*time.Hour, cfg.MaxLoginRemember())
+
+	// session remembered for wiki is shared with finance
+	_, ok := cfg.LoginMaxAge("wiki")
+	assert.False(t, ok)
+	maxAge, ok := cfg.LoginMaxAge("Finance")
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, maxAge)
+	authTime := time.Now().Add(-48 * time.Hour)
+	assert.False(t, cfg.LoginExpired("wiki", authTime))
+	assert.True(t, cfg.LoginExpired("Finance", authTime))
+	assert.False(t, cfg.LoginExpired("Finance", time.Now().Add(-time.Hour)))
+
+	// unknown authentication time
+	assert.False(t, cfg.LoginExpired("wiki", time.Time{}))
+	assert.False(t, cfg.LoginExpired("Finance", time.Time{}))
+
+	// login remembered forever by default
+	cfg.SessionTTL = 0
+	assert.Equal(t, time.Duration(0), cfg.MaxLoginRemember())
+	assert.True(t, cfg.LoginExpired("wiki", time.Now().Add(-1000*time.Hour)))
+	assert.False(t, cfg.LoginExpired("other", time.Time{}))
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing id":        "clients:\n  - loginremember: 24h\n",
+		"duplicated client": "clients:\n  - id: wiki\n  - id: wiki\n",
+		"bad duration":      "clients:\n  - id: wiki\n    loginremember: tomorrow\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writePolicies(t, content)
+			defer os.RemoveAll(filepath.Dir(path))
+			cfg := Config{Url: "http://localhost:4445", PolicyFile: path}
+			assert.Error(t, cfg.Validate())
+		})
+	}
+}
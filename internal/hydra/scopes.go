@@ -0,0 +1,49 @@
+package hydra
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OPENID_SCOPE is always granted as openid connect cannot work without it
+const OPENID_SCOPE = "openid"
+
+func (c *Config) parsedMandatoryScopes() (map[string][]string, error) {
+	result := make(map[string][]string)
+	for _, mandatoryScope := range c.MandatoryScopes {
+		splitted := strings.Split(mandatoryScope, ":")
+		if len(splitted) != 2 {
+			return nil, fmt.Errorf(
+				"one mandatory scope is not well formatted %#v (should contain exactly one `:`)",
+				mandatoryScope)
+		}
+		clientId, scope := splitted[0], splitted[1]
+		result[clientId] = append(result[clientId], scope)
+	}
+	return result, nil
+}
+
+// ScopeMandatory tells if user cannot deselect `scope` on consent page of
+// client
+func (c *Config) ScopeMandatory(clientId, scope string) bool {
+	if scope == OPENID_SCOPE {
+		return true
+	}
+	return contains(c.mandatoryScopes[clientId], scope) || contains(c.mandatoryScopes[ANY_CLIENT], scope)
+}
+
+// GrantedScopes returns scopes requested by client which are either checked
+// by user or mandatory, within scopes allowed by client policy
+func (c *Config) GrantedScopes(resp *HydraResp, checked []string) []string {
+	policy := c.Policy(resp.Client.Id)
+	granted := make([]string, 0, len(resp.RequestedScopes))
+	for _, scope := range resp.RequestedScopes {
+		if !policy.ScopeAllowed(scope) {
+			continue
+		}
+		if contains(checked, scope) || c.ScopeMandatory(resp.Client.Id, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted
+}
@@ -0,0 +1,43 @@
+package hydra
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	cfg := Config{
+		Url:             "http://localhost:4445",
+		MandatoryScopes: []string{"*:profile", "wiki:email"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	resp := &HydraResp{
+		RequestedScopes: []string{"openid", "profile", "email", "roles"},
+		Client:          ClientInfo{Id: "wiki"},
+	}
+	assert.True(t, cfg.ScopeMandatory("wiki", "openid"))
+	assert.True(t, cfg.ScopeMandatory("intranet", "profile"))
+	assert.False(t, cfg.ScopeMandatory("intranet", "email"))
+
+	t.Run("nothing checked", func(t *testing.T) {
+		assert.Equal(t, []string{"openid", "profile", "email"}, cfg.GrantedScopes(resp, nil))
+	})
+
+	t.Run("only requested scopes", func(t *testing.T) {
+		granted := cfg.GrantedScopes(resp, []string{"roles", "offline_access"})
+		assert.Equal(t, []string{"openid", "profile", "email", "roles"}, granted)
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		resp := &HydraResp{
+			RequestedScopes: []string{"openid", "email", "roles"},
+			Client:          ClientInfo{Id: "intranet"},
+		}
+		assert.Equal(t, []string{"openid", "roles"}, cfg.GrantedScopes(resp, []string{"roles"}))
+	})
+
+	cfg.MandatoryScopes = []string{"profile"}
+	assert.Error(t, cfg.Validate())
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,30 +19,105 @@ import (
 
 type reqType int
 
+var ErrNotRevocable = errors.New("hydra cannot revoke a single login session")
+
 type ConsentReq struct {
-	Client hydra.ClientInfo `json:client`
+	Challenge       string           `json:"challenge"`
+	Client          hydra.ClientInfo `json:"client"`
+	RequestedScopes []string         `json:"requested_scope"`
+	// login session during which consent was given
+	LoginSessionId string `json:"login_session_id"`
 }
 
 type ConsentSession struct {
 	GrantScope     []string   `json:"grant_scope"`
+	GrantAudience  []string   `json:"grant_access_token_audience"`
 	HandledAt      time.Time  `json:"handled_at"`
 	ConsentRequest ConsentReq `json:"consent_request"`
+	Remember       bool       `json:"remember"`
+	// seconds consent is remembered, 0 means forever
+	RememberFor int `json:"remember_for"`
+	// claims released to client
+	Session hydra.TokenSession `json:"session"`
+	// expiry of issued tokens by token type, only sent by hydra 2.x
+	TokenExpiry map[string]time.Time `json:"expires_at"`
+}
+
+// ReleasedClaim is a claim put in tokens of client
+type ReleasedClaim struct {
+	Name  string
+	Value interface{}
+	// tokens containing claim
+	Tokens []string
+}
+
+// ExpiresAt returns when hydra forgets consent, zero if never
+func (s *ConsentSession) ExpiresAt() time.Time {
+	if !s.Remember || s.RememberFor <= 0 {
+		return time.Time{}
+	}
+	return s.HandledAt.Add(time.Duration(s.RememberFor) * time.Second)
+}
+
+// ReleasedClaims returns claims of id token and access token sorted by name
+func (s *ConsentSession) ReleasedClaims() []ReleasedClaim {
+	byName := make(map[string]*ReleasedClaim)
+	var names []string
+	add := func(token string, claims map[string]interface{}) {
+		for name, value := range claims {
+			claim, ok := byName[name]
+			if !ok {
+				claim = &ReleasedClaim{Name: name, Value: value}
+				byName[name] = claim
+				names = append(names, name)
+			}
+			claim.Tokens = append(claim.Tokens, token)
+		}
+	}
+	add(hydra.ID_TOKEN, s.Session.IDToken)
+	add(hydra.ACCESS_TOKEN, s.Session.AccessToken)
+	sort.Strings(names)
+	claims := make([]ReleasedClaim, 0, len(names))
+	for _, name := range names {
+		claims = append(claims, *byName[name])
+	}
+	return claims
 }
 
 type reqInfo struct {
 	reqType
 	subject  string
 	clientId string
+	// login session id, only with DEL_LOGIN_SESSION_REQ
+	sessionId string
+	// page parameters, taken from `Link` header of previous page
+	page url.Values
+	// admin api path prefix depending on hydra version
+	prefix string
 }
 
 const (
 	DEL_LOGIN_REQ   reqType = 0
 	DEL_CONSENT_REQ reqType = 1
 	GET_CONSENT_REQ reqType = 2
+	// revocation of a single login session, hydra 2.x only
+	DEL_LOGIN_SESSION_REQ reqType = 3
+)
+
+// page parameters of hydra list endpoints
+const (
+	// hydra 1.x
+	LIMIT_PARAM  = "limit"
+	OFFSET_PARAM = "offset"
+	// hydra 2.x
+	PAGE_SIZE_PARAM  = "page_size"
+	PAGE_TOKEN_PARAM = "page_token"
 )
 
+var pageParams = []string{LIMIT_PARAM, OFFSET_PARAM, PAGE_SIZE_PARAM, PAGE_TOKEN_PARAM}
+
 func (r *reqInfo) ReqPath() string {
-	if r.reqType == DEL_LOGIN_REQ {
+	if r.reqType == DEL_LOGIN_REQ || r.reqType == DEL_LOGIN_SESSION_REQ {
 		return "login"
 	}
 	if r.reqType == DEL_CONSENT_REQ {
@@ -52,20 +130,33 @@ func (r *reqInfo) ReqPath() string {
 }
 
 func call(c hydra.HttpClientInterface, info *reqInfo, jsonResp interface{}) error {
+	_, err := callPage(c, info, jsonResp)
+	return err
+}
+
+// callPage sends request and returns parameters of next page, nil if
+// response is the last page
+func callPage(c hydra.HttpClientInterface, info *reqInfo, jsonResp interface{}) (url.Values, error) {
 	l := logging.FromCtx(c.GetContext())
-	urlPath := fmt.Sprintf("oauth2/auth/sessions/%[1]s", info.ReqPath())
-	values := &url.Values{}
+	urlPath := fmt.Sprintf("%soauth2/auth/sessions/%s", info.prefix, info.ReqPath())
+	values := url.Values{}
+	for param, value := range info.page {
+		values[param] = value
+	}
 	if info.subject != "" {
 		values.Set("subject", info.subject)
 	}
 	if info.clientId != "" {
 		values.Set("client", info.clientId)
 	}
+	if info.sessionId != "" {
+		values.Set("sid", info.sessionId)
+	}
 	urlPath = fmt.Sprintf("%s?%s", urlPath, values.Encode())
 
 	ref, err := url.Parse(urlPath)
 	if err != nil {
-		return errors.Wrap(err, "while parsing url")
+		return nil, errors.Wrap(err, "while parsing url")
 	}
 	var (
 		resp    *http.Response
@@ -77,50 +168,159 @@ func call(c hydra.HttpClientInterface, info *reqInfo, jsonResp interface{}) erro
 		resp, httperr = c.Delete(ref)
 	}
 	if httperr != nil {
-		return errors.Wrap(httperr, "http request to hydra failed")
+		return nil, errors.Wrap(httperr, "http request to hydra failed")
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		// error case, status code should be 2XX
 		if err := hydra.GenericError(c.GetContext(), resp.Body); err != nil {
-			return err
+			return nil, err
 		}
 		l.Debug().
 			Int("statuscode", resp.StatusCode).
 			Msgf("hydra sent error (reqinfo %#v)", info)
-		return fmt.Errorf("hydra sent error with statuscode %v", resp.StatusCode)
+		return nil, fmt.Errorf("hydra sent error with statuscode %v", resp.StatusCode)
 	}
 	if jsonResp != nil {
 		dec := json.NewDecoder(resp.Body)
 		if err := dec.Decode(jsonResp); err != nil {
-			return errors.Wrap(err, "while parsing of response body from hydra server")
+			return nil, errors.Wrap(err, "while parsing of response body from hydra server")
+		}
+	}
+	return nextPage(resp.Header), nil
+}
+
+// nextPage returns page parameters of `next` link of response header
+func nextPage(header http.Header) url.Values {
+	for _, link := range strings.Split(strings.Join(header.Values("Link"), ","), ",") {
+		parts := strings.Split(link, ";")
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, param := range parts[1:] {
+			if rel := strings.TrimSpace(param); rel != `rel="next"` && rel != "rel=next" {
+				continue
+			}
+			u, err := url.Parse(target)
+			if err != nil {
+				return nil
+			}
+			page := url.Values{}
+			for _, name := range pageParams {
+				if value := u.Query().Get(name); value != "" {
+					page.Set(name, value)
+				}
+			}
+			if len(page) == 0 {
+				return nil
+			}
+			return page
 		}
 	}
 	return nil
 }
 
-func FetchConsentSessions(ctx context.Context, cfg *hydra.Config, subject string) ([]ConsentSession, error) {
-	client := &hydra.HttpClient{cfg, ctx}
+// fetchConsentSessions follows pages until the last one or until `max`
+// sessions are read
+func fetchConsentSessions(c hydra.HttpClientInterface, info *reqInfo, max int) ([]ConsentSession, error) {
 	var sess []ConsentSession
-	err := call(client, &reqInfo{reqType: GET_CONSENT_REQ, subject: subject}, &sess)
+	for {
+		var page []ConsentSession
+		next, err := callPage(c, info, &page)
+		if err != nil {
+			return nil, err
+		}
+		sess = append(sess, page...)
+		last := len(page) == 0 || next == nil
+		// bound also applies to the last page, which can be larger than
+		// requested
+		if len(sess) > max || (len(sess) == max && !last) {
+			logging.FromCtx(c.GetContext()).Warn().
+				Str("subject", info.subject).
+				Int("max", max).
+				Msg("too many consent sessions, remaining ones are ignored")
+			return sess[:max], nil
+		}
+		if last {
+			return sess, nil
+		}
+		info.page = next
+	}
+}
+
+func FetchConsentSessions(ctx context.Context, cfg *hydra.Config, subject string) ([]ConsentSession, error) {
+	sess, err := fetchAllConsentSessions(ctx, cfg, subject)
 	if err != nil {
 		return nil, err
 	}
 	return Filter(sess), nil
 }
 
+func fetchAllConsentSessions(ctx context.Context, cfg *hydra.Config, subject string) ([]ConsentSession, error) {
+	client := &hydra.HttpClient{Cfg: cfg, Ctx: ctx}
+	page := url.Values{}
+	if cfg.ApiVersion == hydra.API_V2 {
+		page.Set(PAGE_SIZE_PARAM, strconv.Itoa(cfg.SessionsPageSize))
+	} else {
+		page.Set(LIMIT_PARAM, strconv.Itoa(cfg.SessionsPageSize))
+	}
+	info := &reqInfo{reqType: GET_CONSENT_REQ, subject: subject, page: page, prefix: cfg.ApiPrefix()}
+	return fetchConsentSessions(client, info, cfg.MaxSessions)
+}
+
+// FetchSessionConsents returns most recent consent of each client given
+// during login session `sessionId`
+func FetchSessionConsents(ctx context.Context, cfg *hydra.Config, subject, sessionId string) ([]ConsentSession, error) {
+	sess, err := fetchAllConsentSessions(ctx, cfg, subject)
+	if err != nil {
+		return nil, err
+	}
+	return Filter(LoginSession(sess, sessionId)), nil
+}
+
+// FetchConsentHistory returns consent sessions of user for client, most recent
+// first, hydra only lists consents which are still remembered
+func FetchConsentHistory(ctx context.Context, cfg *hydra.Config, subject, clientId string) ([]ConsentSession, error) {
+	sess, err := fetchAllConsentSessions(ctx, cfg, subject)
+	if err != nil {
+		return nil, err
+	}
+	return History(sess, clientId), nil
+}
+
+// FetchLoginSessionIds returns ids of login sessions of user during which
+// consents still remembered by hydra were given
+func FetchLoginSessionIds(ctx context.Context, cfg *hydra.Config, subject string) ([]string, error) {
+	sess, err := fetchAllConsentSessions(ctx, cfg, subject)
+	if err != nil {
+		return nil, err
+	}
+	return LoginSessionIds(sess), nil
+}
+
 func RevokeApp(ctx context.Context, cfg *hydra.Config, subject, clientid string) error {
 	return call(
-		&hydra.HttpClient{cfg, ctx},
-		&reqInfo{reqType: DEL_CONSENT_REQ, subject: subject, clientId: clientid},
+		&hydra.HttpClient{Cfg: cfg, Ctx: ctx},
+		&reqInfo{reqType: DEL_CONSENT_REQ, subject: subject, clientId: clientid, prefix: cfg.ApiPrefix()},
 		nil,
 	)
 }
 
 func Logout(ctx context.Context, cfg *hydra.Config, subject string) error {
 	return call(
-		&hydra.HttpClient{cfg, ctx},
-		&reqInfo{reqType: DEL_LOGIN_REQ, subject: subject},
+		&hydra.HttpClient{Cfg: cfg, Ctx: ctx},
+		&reqInfo{reqType: DEL_LOGIN_REQ, subject: subject, prefix: cfg.ApiPrefix()},
+		nil,
+	)
+}
+
+// RevokeLoginSession invalidates a single login session of user, hydra 1.x
+// can only invalidate all sessions of user
+func RevokeLoginSession(ctx context.Context, cfg *hydra.Config, sessionId string) error {
+	if !cfg.SessionRevocable() {
+		return ErrNotRevocable
+	}
+	return call(
+		&hydra.HttpClient{Cfg: cfg, Ctx: ctx},
+		&reqInfo{reqType: DEL_LOGIN_SESSION_REQ, sessionId: sessionId, prefix: cfg.ApiPrefix()},
 		nil,
 	)
 }
@@ -5,12 +5,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+
+	"github.com/stregouet/hydra-ldap/internal/hydra"
 	// "github.com/pkg/errors"
 )
 
@@ -57,6 +63,47 @@ func TestGetConsent(t *testing.T) {
 	})
 }
 
+func TestGetConsentApiVersions(t *testing.T) {
+	for version, prefix := range map[string]string{"v1": "", "v2": "admin/"} {
+		t.Run(version, func(t *testing.T) {
+			info := &reqInfo{
+				subject: "jdupont",
+				reqType: GET_CONSENT_REQ,
+				prefix:  prefix,
+			}
+			ref, err := url.Parse(prefix + "oauth2/auth/sessions/consent?subject=jdupont")
+			assert.NoError(t, err)
+			content, err := ioutil.ReadFile(filepath.Join("testdata", version, "consent_sessions.json"))
+			assert.NoError(t, err)
+			client := new(fakeClient)
+			client.On("Get", ref).Return(
+				&http.Response{
+					Body:       newClosableBuffer(string(content)),
+					StatusCode: 200,
+				},
+				nil,
+			)
+			var sess []ConsentSession
+			err = call(client, info, &sess)
+			assert.NoError(t, err)
+			if assert.Len(t, sess, 1) {
+				assert.Equal(t, []string{"openid", "profile"}, sess[0].GrantScope)
+				assert.Equal(t, "wiki", sess[0].ConsentRequest.Client.Id)
+				assert.Equal(t, "Wiki", sess[0].ConsentRequest.Client.Name)
+				assert.False(t, sess[0].HandledAt.IsZero())
+				assert.Equal(t, []string{"openid", "profile"}, sess[0].ConsentRequest.RequestedScopes)
+				assert.Equal(t, "5a1b7e55-5c1b-4d2b-9d9a-2f6c0f4e6a11", sess[0].ConsentRequest.LoginSessionId)
+				assert.Equal(t, sess[0].HandledAt.Add(24*time.Hour), sess[0].ExpiresAt())
+				assert.Equal(
+					t,
+					[]ReleasedClaim{{Name: "name", Value: "Jean Dupont", Tokens: []string{"id_token"}}},
+					sess[0].ReleasedClaims(),
+				)
+			}
+		})
+	}
+}
+
 func TestRemoveConsent(t *testing.T) {
 	info := &reqInfo{
 		subject:  "toto",
@@ -114,6 +161,31 @@ func TestRemoveLogin(t *testing.T) {
 	})
 }
 
+func TestRemoveLoginSession(t *testing.T) {
+	info := &reqInfo{
+		sessionId: "5a1b7e55",
+		reqType:   DEL_LOGIN_SESSION_REQ,
+		prefix:    "admin/",
+	}
+	ref, err := url.Parse("admin/oauth2/auth/sessions/login?sid=5a1b7e55")
+	assert.NoError(t, err)
+	client := new(fakeClient)
+	client.On("Delete", ref).Return(
+		&http.Response{
+			Body:       newClosableBuffer(""),
+			StatusCode: 204,
+		},
+		nil,
+	)
+	err = call(client, info, nil)
+	assert.NoError(t, err)
+	client.AssertExpectations(t)
+
+	cfg := &hydra.Config{Url: "http://localhost:4445", ApiVersion: hydra.API_V1}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, ErrNotRevocable, RevokeLoginSession(context.Background(), cfg, "5a1b7e55"))
+}
+
 type closableBuffer struct {
 	*bytes.Buffer
 }
@@ -127,6 +199,102 @@ func newClosableBuffer(content string) *closableBuffer {
 	}
 }
 
+func TestConsentPagination(t *testing.T) {
+	page := func(client *fakeClient, query, link string, clients ...string) {
+		ref, err := url.Parse("oauth2/auth/sessions/consent?" + query)
+		assert.NoError(t, err)
+		var body []string
+		for _, c := range clients {
+			body = append(body, fmt.Sprintf(`{"consent_request": {"client": {"client_id": %#v}}}`, c))
+		}
+		header := http.Header{}
+		if link != "" {
+			header.Set("Link", link)
+		}
+		client.On("Get", ref).Return(
+			&http.Response{
+				Header:     header,
+				Body:       newClosableBuffer("[" + strings.Join(body, ",") + "]"),
+				StatusCode: 200,
+			},
+			nil,
+		).Once()
+	}
+	ids := func(sess []ConsentSession) []string {
+		var result []string
+		for _, s := range sess {
+			result = append(result, s.ConsentRequest.Client.Id)
+		}
+		return result
+	}
+
+	t.Run("limit and offset", func(t *testing.T) {
+		client := new(fakeClient)
+		page(client, "limit=2&subject=jdupont",
+			`</oauth2/auth/sessions/consent?subject=jdupont&limit=2&offset=2>; rel="next", </oauth2/auth/sessions/consent?subject=jdupont&limit=2&offset=2>; rel="last"`,
+			"wiki", "chat")
+		page(client, "limit=2&offset=2&subject=jdupont",
+			`</oauth2/auth/sessions/consent?subject=jdupont&limit=2&offset=0>; rel="first"`,
+			"finance")
+		info := &reqInfo{reqType: GET_CONSENT_REQ, subject: "jdupont", page: url.Values{LIMIT_PARAM: {"2"}}}
+		sess, err := fetchConsentSessions(client, info, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wiki", "chat", "finance"}, ids(sess))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("page token", func(t *testing.T) {
+		client := new(fakeClient)
+		page(client, "page_size=2&subject=jdupont",
+			`</admin/oauth2/auth/sessions/consent?page_size=2&page_token=abc>; rel="next"`,
+			"wiki", "chat")
+		page(client, "page_size=2&page_token=abc&subject=jdupont", "", "finance")
+		info := &reqInfo{reqType: GET_CONSENT_REQ, subject: "jdupont", page: url.Values{PAGE_SIZE_PARAM: {"2"}}}
+		sess, err := fetchConsentSessions(client, info, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wiki", "chat", "finance"}, ids(sess))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("upper bound", func(t *testing.T) {
+		client := new(fakeClient)
+		page(client, "limit=2&subject=jdupont",
+			`</oauth2/auth/sessions/consent?limit=2&offset=2>; rel="next"`,
+			"wiki", "chat")
+		page(client, "limit=2&offset=2&subject=jdupont",
+			`</oauth2/auth/sessions/consent?limit=2&offset=4>; rel="next"`,
+			"finance", "mail")
+		info := &reqInfo{reqType: GET_CONSENT_REQ, subject: "jdupont", page: url.Values{LIMIT_PARAM: {"2"}}}
+		sess, err := fetchConsentSessions(client, info, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wiki", "chat", "finance"}, ids(sess))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("upper bound on last page", func(t *testing.T) {
+		client := new(fakeClient)
+		page(client, "limit=2&subject=jdupont",
+			`</oauth2/auth/sessions/consent?limit=2&offset=2>; rel="next"`,
+			"wiki", "chat")
+		page(client, "limit=2&offset=2&subject=jdupont", "", "finance", "mail")
+		info := &reqInfo{reqType: GET_CONSENT_REQ, subject: "jdupont", page: url.Values{LIMIT_PARAM: {"2"}}}
+		sess, err := fetchConsentSessions(client, info, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wiki", "chat", "finance"}, ids(sess))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("single page above upper bound", func(t *testing.T) {
+		client := new(fakeClient)
+		page(client, "limit=2&subject=jdupont", "", "wiki", "chat")
+		info := &reqInfo{reqType: GET_CONSENT_REQ, subject: "jdupont", page: url.Values{LIMIT_PARAM: {"2"}}}
+		sess, err := fetchConsentSessions(client, info, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wiki"}, ids(sess))
+		client.AssertExpectations(t)
+	})
+}
+
 type fakeClient struct {
 	mock.Mock
 }
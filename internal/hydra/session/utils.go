@@ -1,5 +1,10 @@
 package session
 
+import (
+	"sort"
+	"time"
+)
+
 // will keep only most recent session for each client
 func Filter(sess []ConsentSession) []ConsentSession {
 	byClient := make(map[string][]ConsentSession)
@@ -17,5 +22,87 @@ func Filter(sess []ConsentSession) []ConsentSession {
 		}
 		filtered = append(filtered, mostRecent)
 	}
+	// stable order so that sessions can be paginated
+	sort.Slice(filtered, func(i, j int) bool {
+		a, b := filtered[i].ConsentRequest.Client, filtered[j].ConsentRequest.Client
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Id < b.Id
+	})
 	return filtered
 }
+
+// History keeps sessions of client, most recent first
+func History(sess []ConsentSession, clientId string) []ConsentSession {
+	history := make([]ConsentSession, 0)
+	for _, s := range sess {
+		if s.ConsentRequest.Client.Id == clientId {
+			history = append(history, s)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].HandledAt.After(history[j].HandledAt)
+	})
+	return history
+}
+
+// MergeHistory completes consents recorded when they were accepted with
+// consents remembered by hydra given before the oldest record (eg. before
+// consents were recorded), most recent first. Token expiry, only known by
+// hydra, is copied to records of the same consent request.
+func MergeHistory(recorded, remembered []ConsentSession) []ConsentSession {
+	expiry := make(map[string]map[string]time.Time)
+	for _, s := range remembered {
+		if s.ConsentRequest.Challenge != "" {
+			expiry[s.ConsentRequest.Challenge] = s.TokenExpiry
+		}
+	}
+	history := make([]ConsentSession, 0, len(recorded)+len(remembered))
+	var oldest time.Time
+	for _, s := range recorded {
+		if tokenExpiry, ok := expiry[s.ConsentRequest.Challenge]; ok && s.ConsentRequest.Challenge != "" {
+			s.TokenExpiry = tokenExpiry
+		}
+		if oldest.IsZero() || s.HandledAt.Before(oldest) {
+			oldest = s.HandledAt
+		}
+		history = append(history, s)
+	}
+	for _, s := range remembered {
+		if len(recorded) == 0 || s.HandledAt.Before(oldest) {
+			history = append(history, s)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].HandledAt.After(history[j].HandledAt)
+	})
+	return history
+}
+
+// LoginSession keeps sessions of consents given during login session
+// `sessionId`
+func LoginSession(sess []ConsentSession, sessionId string) []ConsentSession {
+	result := make([]ConsentSession, 0)
+	for _, s := range sess {
+		if sessionId != "" && s.ConsentRequest.LoginSessionId == sessionId {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// LoginSessionIds returns ids of login sessions during which consents were
+// given
+func LoginSessionIds(sess []ConsentSession) []string {
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, s := range sess {
+		sid := s.ConsentRequest.LoginSessionId
+		if sid != "" && !seen[sid] {
+			seen[sid] = true
+			ids = append(ids, sid)
+		}
+	}
+	return ids
+}
@@ -40,22 +40,79 @@ func TestFilterSession(t *testing.T) {
 
 	expected := []ConsentSession{
 		{
-			HandledAt: now.Add(1 * time.Second),
+			HandledAt: now.Add(2 * time.Second),
 			ConsentRequest: ConsentReq{
 				Client: hydra.ClientInfo{
-					Id: "client1",
+					Id: "client0",
 				},
 			},
 		},
 		{
-			HandledAt: now.Add(2 * time.Second),
+			HandledAt: now.Add(1 * time.Second),
 			ConsentRequest: ConsentReq{
 				Client: hydra.ClientInfo{
-					Id: "client0",
+					Id: "client1",
 				},
 			},
 		},
 	}
 
-	assert.ElementsMatch(t, expected, Filter(sess))
+	assert.Equal(t, expected, Filter(sess))
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Now()
+	wiki := ConsentReq{Client: hydra.ClientInfo{Id: "wiki"}}
+	sess := []ConsentSession{
+		{HandledAt: now, ConsentRequest: wiki, GrantScope: []string{"openid"}},
+		{HandledAt: now, ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "chat"}}},
+		{HandledAt: now.Add(time.Hour), ConsentRequest: wiki, GrantScope: []string{"openid", "email"}},
+	}
+	assert.Equal(t, []ConsentSession{sess[2], sess[0]}, History(sess, "wiki"))
+	assert.Empty(t, History(sess, "finance"))
+}
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Now()
+	s := ConsentSession{HandledAt: now, Remember: true, RememberFor: 3600}
+	assert.Equal(t, now.Add(time.Hour), s.ExpiresAt())
+	s.RememberFor = 0
+	assert.True(t, s.ExpiresAt().IsZero())
+}
+
+func TestLoginSession(t *testing.T) {
+	wiki := ConsentSession{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "wiki"}, LoginSessionId: "laptop"}}
+	chat := ConsentSession{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "chat"}, LoginSessionId: "phone"}}
+	sess := []ConsentSession{wiki, chat}
+	assert.Equal(t, []ConsentSession{wiki}, LoginSession(sess, "laptop"))
+	assert.Empty(t, LoginSession(sess, ""))
+}
+
+func TestLoginSessionIds(t *testing.T) {
+	sess := []ConsentSession{
+		{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "wiki"}, LoginSessionId: "laptop"}},
+		{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "chat"}, LoginSessionId: "phone"}},
+		{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "chat"}, LoginSessionId: "laptop"}},
+		{ConsentRequest: ConsentReq{Client: hydra.ClientInfo{Id: "mail"}}},
+	}
+	assert.Equal(t, []string{"laptop", "phone"}, LoginSessionIds(sess))
+}
+
+func TestMergeHistory(t *testing.T) {
+	now := time.Now()
+	expiry := map[string]time.Time{"access_token": now.Add(time.Hour)}
+	wiki := func(challenge string, at time.Time) ConsentSession {
+		return ConsentSession{HandledAt: at, ConsentRequest: ConsentReq{Challenge: challenge, Client: hydra.ClientInfo{Id: "wiki"}}}
+	}
+	// consent given before consents were recorded
+	before := wiki("before", now.Add(-48*time.Hour))
+	remembered := wiki("current", now)
+	remembered.TokenExpiry = expiry
+	// consent hydra forgot
+	forgotten := wiki("forgotten", now.Add(-time.Hour))
+	recorded := []ConsentSession{wiki("current", now), forgotten}
+
+	history := MergeHistory(recorded, []ConsentSession{remembered, before})
+	assert.Equal(t, []ConsentSession{remembered, forgotten, before}, history)
+	assert.Equal(t, []ConsentSession{remembered, before}, MergeHistory(nil, []ConsentSession{remembered, before}))
 }
@@ -0,0 +1,72 @@
+package hydra
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokens where a claim can be put
+const (
+	ID_TOKEN     = "id_token"
+	ACCESS_TOKEN = "access_token"
+	BOTH_TOKENS  = "both"
+	// claim target applying to every client
+	ANY_CLIENT = "*"
+)
+
+// TokenSession contains claims sent to hydra when accepting consent request,
+// access token claims are also returned by token introspection
+type TokenSession struct {
+	IDToken     map[string]interface{} `json:"id_token,omitempty"`
+	AccessToken map[string]interface{} `json:"access_token,omitempty"`
+}
+
+// parsedClaimTargets returns target of claims by client id
+func (c *Config) parsedClaimTargets() (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string)
+	for _, claimTarget := range c.ClaimTargets {
+		splitted := strings.Split(claimTarget, ":")
+		if len(splitted) != 3 {
+			return nil, fmt.Errorf(
+				"one claim target is not well formatted %#v (should contain exactly two `:`)",
+				claimTarget)
+		}
+		clientId, claim, target := splitted[0], splitted[1], splitted[2]
+		switch target {
+		case ID_TOKEN, ACCESS_TOKEN, BOTH_TOKENS:
+		default:
+			return nil, fmt.Errorf("unknown claim target %#v", target)
+		}
+		if result[clientId] == nil {
+			result[clientId] = make(map[string]string)
+		}
+		result[clientId][claim] = target
+	}
+	return result, nil
+}
+
+// TokenSession dispatches claims between id token and access token
+// according to targets configured for client, claims go to id token by
+// default
+func (c *Config) TokenSession(clientId string, claims *Claim) *TokenSession {
+	session := &TokenSession{
+		IDToken:     make(map[string]interface{}),
+		AccessToken: make(map[string]interface{}),
+	}
+	for claim, value := range claims.prepareMarshal() {
+		target, ok := c.claimTargets[clientId][claim]
+		if !ok {
+			target, ok = c.claimTargets[ANY_CLIENT][claim]
+		}
+		if !ok {
+			target = ID_TOKEN
+		}
+		if target == ID_TOKEN || target == BOTH_TOKENS {
+			session.IDToken[claim] = value
+		}
+		if target == ACCESS_TOKEN || target == BOTH_TOKENS {
+			session.AccessToken[claim] = value
+		}
+	}
+	return session
+}
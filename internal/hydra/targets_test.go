@@ -0,0 +1,61 @@
+package hydra
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenSession(t *testing.T) {
+	cfg := Config{
+		Url: "http://localhost:4445",
+		ClaimTargets: []string{
+			"*:roles:both",
+			"api:email:access_token",
+			"api:roles:access_token",
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	claims := &Claim{
+		Details: map[string]interface{}{
+			"name":  "Jean",
+			"email": "jean.dupont@example.com",
+		},
+		Roles: []string{"admin"},
+	}
+
+	t.Run("default targets", func(t *testing.T) {
+		expected := &TokenSession{
+			IDToken: map[string]interface{}{
+				"name":  "Jean",
+				"email": "jean.dupont@example.com",
+				"roles": []string{"admin"},
+			},
+			AccessToken: map[string]interface{}{
+				"roles": []string{"admin"},
+			},
+		}
+		assert.Equal(t, expected, cfg.TokenSession("wiki", claims))
+	})
+
+	t.Run("client targets", func(t *testing.T) {
+		expected := &TokenSession{
+			IDToken: map[string]interface{}{
+				"name": "Jean",
+			},
+			AccessToken: map[string]interface{}{
+				"email": "jean.dupont@example.com",
+				"roles": []string{"admin"},
+			},
+		}
+		assert.Equal(t, expected, cfg.TokenSession("api", claims))
+	})
+
+	t.Run("bad config", func(t *testing.T) {
+		cfg.ClaimTargets = []string{"api:email:refresh_token"}
+		assert.Error(t, cfg.Validate())
+		cfg.ClaimTargets = []string{"email:access_token"}
+		assert.Error(t, cfg.Validate())
+	})
+}
@@ -0,0 +1,243 @@
+package hydra
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// HttpConfig configures http client used to call hydra admin api
+type HttpConfig struct {
+	// timeout of each request attempt (default 10s)
+	Timeout time.Duration
+	// timeout to establish a connection (default 5s)
+	DialTimeout time.Duration
+	// keep-alive period of connections (default 30s)
+	KeepAlive time.Duration
+	// idle connections kept open to hydra (default 16)
+	MaxIdleConns int
+	// how long an idle connection is kept open (default 90s)
+	IdleConnTimeout time.Duration
+	// number of retries of failed requests (default 2, -1 disables)
+	Retries int
+	// initial delay between retries, doubled at each retry (default 100ms)
+	RetryBackoff time.Duration
+	// consecutive failures before requests fail fast without calling hydra
+	// (default 5, -1 disables)
+	BreakerThreshold int
+	// how long requests fail fast once breaker is open (default 30s)
+	BreakerCooldown time.Duration
+}
+
+func (c *HttpConfig) Validate() {
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = 30 * time.Second
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 16
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 90 * time.Second
+	}
+	if c.Retries == 0 {
+		c.Retries = 2
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.BreakerThreshold == 0 {
+		c.BreakerThreshold = 5
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = 30 * time.Second
+	}
+}
+
+// transport is shared by all requests to hydra
+type transport struct {
+	cfg     *HttpConfig
+	client  *http.Client
+	breaker *breaker
+}
+
+func newTransport(cfg *HttpConfig, auth *AuthConfig) (*transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	tlsCfg, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	base := &http.Transport{
+		DialContext:         auth.dialer(dialer),
+		TLSClientConfig:     tlsCfg,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConns,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+	// a proxy would be dialed through the socket instead of hydra
+	if auth.Socket == "" {
+		base.Proxy = http.ProxyFromEnvironment
+	}
+	return &transport{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: auth.roundTripper(base),
+		},
+		breaker: &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+	}, nil
+}
+
+// do sends request, retrying it with exponential backoff when it is safe:
+// idempotent requests are retried on connection errors and 5xx responses,
+// others only when connection could not be established
+func (t *transport) do(r *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+	idempotent := r.Method == http.MethodGet || r.Method == http.MethodDelete
+	backoff := t.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "while rewinding request body")
+			}
+			r.Body = body
+		}
+		resp, err := t.client.Do(r)
+		if r.Context().Err() != nil {
+			// request aborted by caller (eg. user left the page) tells
+			// nothing about hydra
+			return resp, err
+		}
+		retry := false
+		switch {
+		case err != nil:
+			retry = idempotent || isDialError(err)
+		case resp.StatusCode >= 500:
+			retry = idempotent
+		}
+		t.breaker.record(err == nil && resp.StatusCode < 500)
+		if !retry || attempt >= t.cfg.Retries || !t.breaker.allow() {
+			return resp, err
+		}
+		if resp != nil {
+			// drain body so that connection can be reused
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		logging.FromCtx(r.Context()).Debug().
+			Int("attempt", attempt+1).
+			Str("url", r.URL.String()).
+			Msg("retrying request to hydra")
+		if err := sleep(r.Context(), jitter(backoff)); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// isDialError tells if connection to hydra could not be established, so
+// request was not sent
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// breaker stops calling hydra after `threshold` consecutive failures, until
+// `cooldown` is elapsed where a single request is let through to probe hydra
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() bool {
+	if b.threshold < 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// half-open: let this request probe hydra and fail fast others until
+	// it completes
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *breaker) record(success bool) {
+	if b.threshold < 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		logging.Error().Dur("cooldown", b.cooldown).Msg("too many failures, stop calling hydra")
+	}
+}
+
+// bodyBytes returns request body that can be sent several times
+func bodyBytes(body io.Reader) (*bytes.Reader, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading request body")
+	}
+	return bytes.NewReader(content), nil
+}
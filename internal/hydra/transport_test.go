@@ -0,0 +1,121 @@
+package hydra
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTransport(threshold int) *transport {
+	cfg := &HttpConfig{
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: threshold,
+		BreakerCooldown:  time.Minute,
+	}
+	cfg.Validate()
+	tr, _ := newTransport(cfg, &AuthConfig{})
+	return tr
+}
+
+func TestTransportRetry(t *testing.T) {
+	t.Run("get retried on 5xx", func(t *testing.T) {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer srv.Close()
+
+		r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+		resp, err := newTestTransport(-1).do(r)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("put not retried on 5xx", func(t *testing.T) {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+
+		r, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, srv.URL, bytes.NewReader([]byte(`{}`)))
+		resp, err := newTestTransport(-1).do(r)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("put retried when connection fails", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+
+		r, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, srv.URL, bytes.NewReader([]byte(`{}`)))
+		tr := newTestTransport(5)
+		_, err := tr.do(r)
+		assert.Error(t, err)
+		assert.Equal(t, 3, tr.breaker.failures)
+	})
+}
+
+func TestTransportBreaker(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, `{}`, string(body))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tr := newTestTransport(2)
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, srv.URL, bytes.NewReader([]byte(`{}`)))
+		_, err := tr.do(r)
+		assert.NoError(t, err)
+	}
+	r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+	_, err := tr.do(r)
+	assert.Equal(t, ErrUnavailable, err)
+	assert.Equal(t, 2, calls)
+
+	// hydra is probed again once cooldown is elapsed
+	tr.breaker.openUntil = time.Now()
+	_, err = tr.do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestTransportCancelled(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	tr := newTestTransport(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	_, err := tr.do(r)
+	assert.Error(t, err)
+	// neither retried nor counted as a failure of hydra
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 0, tr.breaker.failures)
+	assert.True(t, tr.breaker.allow())
+}
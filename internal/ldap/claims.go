@@ -0,0 +1,104 @@
+package ldap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types of claims mapped from ldap attributes, given as `ldapattr:claim:type`
+const (
+	// attribute value as is (default)
+	STRING_CLAIM = "string"
+	// `TRUE`/`FALSE` attribute
+	BOOL_CLAIM = "bool"
+	// integer attribute
+	INT_CLAIM = "int"
+	// generalizedTime attribute converted to seconds since epoch
+	EPOCH_CLAIM = "epoch"
+	// attribute holding a json value
+	JSON_CLAIM = "json"
+)
+
+var claimTypes = []string{STRING_CLAIM, BOOL_CLAIM, INT_CLAIM, EPOCH_CLAIM, JSON_CLAIM}
+
+// layouts of ldap generalizedTime
+var generalizedTimeLayouts = []string{
+	"20060102150405Z0700",
+	"20060102150405.999999999Z0700",
+	"200601021504Z0700",
+}
+
+// splitClaim splits `claim:type` mapping, type defaults to string
+func splitClaim(mapping string) (claim, claimType string) {
+	parts := strings.SplitN(mapping, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], STRING_CLAIM
+	}
+	return parts[0], parts[1]
+}
+
+// validateClaim checks type and name of claim mapping
+func validateClaim(mapping string) error {
+	claim, claimType := splitClaim(mapping)
+	if claim == "" {
+		return fmt.Errorf("empty claim name in %#v", mapping)
+	}
+	if !contains(claimTypes, claimType) {
+		return fmt.Errorf("unknown claim type %#v", claimType)
+	}
+	for _, part := range strings.Split(claim, ".") {
+		if part == "" {
+			return fmt.Errorf("empty part in claim name %#v", claim)
+		}
+	}
+	return nil
+}
+
+// claimValue converts ldap attribute value according to claim type
+func claimValue(value, claimType string) (interface{}, error) {
+	switch claimType {
+	case BOOL_CLAIM:
+		return strconv.ParseBool(strings.ToLower(value))
+	case INT_CLAIM:
+		return strconv.ParseInt(value, 10, 64)
+	case EPOCH_CLAIM:
+		for _, layout := range generalizedTimeLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Unix(), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid generalized time %#v", value)
+	case JSON_CLAIM:
+		var result interface{}
+		if err := json.Unmarshal([]byte(value), &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+// setClaim sets claim in details, a dotted claim name (eg.
+// `address.locality`) is set in a nested object
+func setClaim(details map[string]interface{}, claim string, value interface{}) {
+	parts := strings.Split(claim, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := details[part].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			details[part] = nested
+		}
+		details = nested
+	}
+	details[parts[len(parts)-1]] = value
+}
+
+// topClaim returns name of the claim released to client, `address` for
+// `address.locality`
+func topClaim(claim string) string {
+	return strings.SplitN(claim, ".", 2)[0]
+}
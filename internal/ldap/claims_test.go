@@ -0,0 +1,59 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimValue(t *testing.T) {
+	for name, tc := range map[string]struct {
+		value     string
+		claimType string
+		expected  interface{}
+	}{
+		"string":             {"Jean Dupont", STRING_CLAIM, "Jean Dupont"},
+		"ldap boolean":       {"TRUE", BOOL_CLAIM, true},
+		"integer":            {"42", INT_CLAIM, int64(42)},
+		"generalized time":   {"20200403081240Z", EPOCH_CLAIM, int64(1585901560)},
+		"fractional seconds": {"20200403081240.5+0200", EPOCH_CLAIM, int64(1585894360)},
+		"json":               {`{"locale": "fr"}`, JSON_CLAIM, map[string]interface{}{"locale": "fr"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			value, err := claimValue(tc.value, tc.claimType)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, value)
+		})
+	}
+
+	_, err := claimValue("yes please", BOOL_CLAIM)
+	assert.Error(t, err)
+	_, err = claimValue("2020-04-03", EPOCH_CLAIM)
+	assert.Error(t, err)
+}
+
+func TestValidateClaims(t *testing.T) {
+	c := Config{Attrs: []string{"mail:email", "emailVerified:email_verified:bool", "l:address.locality"}}
+	assert.NoError(t, c.Validate())
+	c = Config{Attrs: []string{"modifyTimestamp:updated_at:date"}}
+	assert.Error(t, c.Validate())
+	c = Config{Attrs: []string{"l:address..locality"}}
+	assert.Error(t, c.Validate())
+	c = Config{ClientAttrs: []string{"hr:employeeNumber:employee_number:float"}}
+	assert.Error(t, c.Validate())
+}
+
+func TestSetClaim(t *testing.T) {
+	details := map[string]interface{}{}
+	setClaim(details, "name", "Jean Dupont")
+	setClaim(details, "address.locality", "Paris")
+	setClaim(details, "address.country", "FR")
+	expected := map[string]interface{}{
+		"name": "Jean Dupont",
+		"address": map[string]interface{}{
+			"locality": "Paris",
+			"country":  "FR",
+		},
+	}
+	assert.Equal(t, expected, details)
+}
@@ -1,7 +1,25 @@
 package ldap
 
 import (
+	"fmt"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	ldaplib "gopkg.in/ldap.v2"
+
+	"github.com/stregouet/hydra-ldap/internal/hydra"
+)
+
+// ROLES_ATTR is the pseudo attribute mapping roles of user to a claim
+const ROLES_ATTR = "roles"
+
+const (
+	// search directory with admin account (or anonymously)
+	SERVICE_BIND = "service"
+	// search directory with user's own credentials
+	USER_BIND = "user"
 )
 
 type Config struct {
@@ -10,10 +28,73 @@ type Config struct {
 	Basedn     string
 	RoleBaseDN string
 
+	// endpoints used for searches, tried in order (default to `Endpoint`)
+	ReadEndpoints []string
+	// endpoints of writable primary, tried in order (default to `Endpoint`)
+	WriteEndpoints []string
+	// duration during which reads of a user are sent to write endpoints
+	// after a write to its entry, so stale replicas are not read (0 disables)
+	ReadAfterWrite time.Duration
+
 	Admindn string
 	Adminpw string
 
+	// either `service` (default) or `user`, in `user` mode the user binds
+	// first and the directory is searched under this bind
+	BindMode string
+	// template of user DN used to bind in `user` mode (eg.
+	// `uid=%s,ou=users,dc=example,dc=com`)
+	UserDNTemplate string
+	// domain used to bind with user principal name in `user` mode when
+	// `UserDNTemplate` is empty
+	UpnDomain string
+
+	// timeouts of each ldap operation (default to 60s)
+	ConnectTimeout time.Duration
+	BindTimeout    time.Duration
+	SearchTimeout  time.Duration
+
+	// directory type used to set default values of `UserFilter`,
+	// `RoleFilter`, `RoleAttr` and `SubjectAttr`: one of openldap, ad,
+	// freeipa, 389ds or auto (detected at startup)
+	Directory string
+	// ldap search filter for user (`%[1]s` is replaced by username)
+	UserFilter string
+	// ldap search filter for roles (`%s` is replaced by user DN)
+	RoleFilter string
+	// attribute of group entries used as role name
+	RoleAttr string
+
+	// ldap filters evaluated against user entry granting access to an app
+	// in addition to group membership, as `clientid:filter` strings
+	AppFilters []string
+	// attribute of `ou=<clientid>` app entry holding a filter granting
+	// access to this app (used when app is missing from `AppFilters`)
+	AppFilterAttr string
+
+	// claims mapped from ldap attributes, as `ldapattr:claim[:type]` strings
+	// where type is one of string (default), bool, int, epoch or json, a
+	// dotted claim (eg. `l:address.locality`) is nested in an object
 	Attrs []string
+	// per-client overrides of Attrs, as `clientid:ldapattr:claim[:type]`
+	// strings, `roles` pseudo attribute renames roles claim
+	ClientAttrs []string
+
+	pins      *pinRegistry
+	writeBack *writeBackQueue
+
+	// attributes updated after each login attempt
+	WriteBack WriteBackConfig
+
+	// attributes checked in order to pick an entry when a username matches
+	// several ones, the entry whose attribute equals the username is picked
+	Precedence []string
+
+	// transformations applied to username before searching it
+	Normalize NormalizeConfig
+	// ldap attribute whose value is used as hydra subject, if empty the
+	// normalized username is used
+	SubjectAttr string
 }
 
 func (c *Config) attrsMap() map[string]string {
@@ -28,6 +109,148 @@ func (c *Config) attrsMap() map[string]string {
 	return result
 }
 
+// clientAttrsMap returns claim mapping (`claim[:type]`) of each ldap
+// attribute for client, Attrs merged with overrides of client
+func (c *Config) clientAttrsMap(clientId string) map[string]string {
+	result := c.attrsMap()
+	for _, clientAttr := range c.ClientAttrs {
+		parts := strings.SplitN(clientAttr, ":", 3)
+		if len(parts) != 3 {
+			panic("clientAttrsMap expects list of `clientid:ldapattr:claim` strings")
+		}
+		if parts[0] == clientId {
+			result[parts[1]] = parts[2]
+		}
+	}
+	return result
+}
+
+// ClaimNames returns names of claims which can be released to client
+func (c *Config) ClaimNames(clientId string) []string {
+	attrs := c.clientAttrsMap(clientId)
+	names := make([]string, 0, len(attrs)+1)
+	for _, mapping := range attrs {
+		claim, _ := splitClaim(mapping)
+		if name := topClaim(claim); !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if _, ok := attrs[ROLES_ATTR]; !ok {
+		names = append(names, hydra.ROLES_CLAIM)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) userFilter() string {
+	if c.UserFilter == "" {
+		return userFilter
+	}
+	return c.UserFilter
+}
+
+func (c *Config) roleFilter() string {
+	if c.RoleFilter == "" {
+		return roleFilter
+	}
+	return c.RoleFilter
+}
+
+func (c *Config) roleAttr() string {
+	if c.RoleAttr == "" {
+		return "cn"
+	}
+	return c.RoleAttr
+}
+
+func (c *Config) appFiltersMap() map[string]string {
+	result := make(map[string]string)
+	for _, appFilter := range c.AppFilters {
+		parts := strings.SplitN(appFilter, ":", 2)
+		if len(parts) != 2 {
+			panic("appFiltersMap expects list of `:` separated strings")
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result
+}
+
 func (cfg *Config) Validate() error {
+	cfg.pins = &pinRegistry{until: make(map[string]time.Time)}
+	switch cfg.BindMode {
+	case "":
+		cfg.BindMode = SERVICE_BIND
+	case SERVICE_BIND:
+	case USER_BIND:
+		if cfg.UserDNTemplate == "" && cfg.UpnDomain == "" {
+			return fmt.Errorf("`user` bind mode requires either userdntemplate or upndomain")
+		}
+		if cfg.UserDNTemplate != "" && strings.Count(cfg.UserDNTemplate, "%s") != 1 {
+			return fmt.Errorf("userdntemplate should contain exactly one `%%s`")
+		}
+	default:
+		return fmt.Errorf("unknown ldap bind mode %#v", cfg.BindMode)
+	}
+	if cfg.WriteBack.Enabled && cfg.Admindn == "" {
+		return fmt.Errorf("ldap write-back requires admindn")
+	}
+	if cfg.WriteBack.Workers == 0 {
+		cfg.WriteBack.Workers = 4
+	}
+	if cfg.WriteBack.QueueSize == 0 {
+		cfg.WriteBack.QueueSize = 100
+	}
+	if cfg.WriteBack.Workers < 0 || cfg.WriteBack.QueueSize < 0 {
+		return fmt.Errorf("negative ldap write-back workers or queue size")
+	}
+	for _, format := range []string{cfg.WriteBack.LastLoginFormat, cfg.WriteBack.LastFailureFormat} {
+		if !validTimeFormat(format) {
+			return fmt.Errorf("unknown ldap write-back time format %#v", format)
+		}
+	}
+	cfg.writeBack = newWriteBackQueue(cfg.WriteBack.Workers, cfg.WriteBack.QueueSize)
+	switch cfg.Directory {
+	case "", AUTO:
+	case OPENLDAP, AD, FREEIPA, DS389:
+		cfg.applyPreset(cfg.Directory)
+	default:
+		return fmt.Errorf("unknown directory type %#v", cfg.Directory)
+	}
+	for _, attr := range cfg.Attrs {
+		parts := strings.SplitN(attr, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("attr %#v should be formatted as `ldapattr:claim[:type]`", attr)
+		}
+		if err := validateClaim(parts[1]); err != nil {
+			return errors.Wrapf(err, "invalid attr %#v", attr)
+		}
+	}
+	for _, clientAttr := range cfg.ClientAttrs {
+		parts := strings.SplitN(clientAttr, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("client attr %#v should be formatted as `clientid:ldapattr:claim[:type]`", clientAttr)
+		}
+		if err := validateClaim(parts[2]); err != nil {
+			return errors.Wrapf(err, "invalid client attr %#v", clientAttr)
+		}
+	}
+	for _, appFilter := range cfg.AppFilters {
+		parts := strings.SplitN(appFilter, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("app filter %#v should be formatted as `clientid:filter`", appFilter)
+		}
+		if _, err := ldaplib.CompileFilter(parts[1]); err != nil {
+			return errors.Wrapf(err, "invalid filter for app %s", parts[0])
+		}
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = ldaplib.DefaultTimeout
+	}
+	if cfg.BindTimeout == 0 {
+		cfg.BindTimeout = ldaplib.DefaultTimeout
+	}
+	if cfg.SearchTimeout == 0 {
+		cfg.SearchTimeout = ldaplib.DefaultTimeout
+	}
 	return nil
 }
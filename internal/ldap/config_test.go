@@ -17,3 +17,37 @@ func TestAttrsMap(t *testing.T) {
 	}
 	assert.Equal(t, expected, result)
 }
+
+func TestClientAttrsMap(t *testing.T) {
+	c := Config{
+		Attrs:       []string{"name:name", "mail:email"},
+		ClientAttrs: []string{"sharepoint:mail:upn", "sharepoint:roles:groups", "hr:employeeNumber:employee_number"},
+	}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, map[string]string{"name": "name", "mail": "email"}, c.clientAttrsMap("wiki"))
+	expected := map[string]string{
+		"name":  "name",
+		"mail":  "upn",
+		"roles": "groups",
+	}
+	assert.Equal(t, expected, c.clientAttrsMap("sharepoint"))
+	assert.Equal(t, []string{"groups", "name", "upn"}, c.ClaimNames("sharepoint"))
+	assert.Equal(t, []string{"email", "employee_number", "name", "roles"}, c.ClaimNames("hr"))
+
+	c = Config{ClientAttrs: []string{"sharepoint:mail"}}
+	assert.Error(t, c.Validate())
+	c = Config{Attrs: []string{"mail"}}
+	assert.Error(t, c.Validate())
+}
+
+func TestValidateAppFilters(t *testing.T) {
+	c := Config{AppFilters: []string{"app:(employeeType=staff)"}}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, map[string]string{"app": "(employeeType=staff)"}, c.appFiltersMap())
+
+	c = Config{AppFilters: []string{"app:(employeeType=staff"}}
+	assert.Error(t, c.Validate())
+
+	c = Config{AppFilters: []string{"(employeeType=staff)"}}
+	assert.Error(t, c.Validate())
+}
@@ -0,0 +1,176 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldaplib "gopkg.in/ldap.v2"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+const (
+	OPENLDAP = "openldap"
+	AD       = "ad"
+	FREEIPA  = "freeipa"
+	DS389    = "389ds"
+	// detect directory type from rootDSE at startup
+	AUTO = "auto"
+)
+
+// LDAP_CAP_ACTIVE_DIRECTORY_OID advertised by active directory in
+// `supportedCapabilities`
+const adCapability = "1.2.840.113556.1.4.800"
+
+// OpenLDAP private enterprise arc, used by its controls and features
+const openldapArc = "1.3.6.1.4.1.4203."
+
+type preset struct {
+	userFilter  string
+	roleFilter  string
+	roleAttr    string
+	subjectAttr string
+	// format of write-back times
+	timeFormat string
+}
+
+var presets = map[string]preset{
+	OPENLDAP: {
+		userFilter:  "(&(objectClass=inetOrgPerson)(|(uid=%[1]s)(mail=%[1]s)))",
+		roleFilter:  "(member=%s)",
+		roleAttr:    "cn",
+		subjectAttr: "uid",
+		timeFormat:  GENERALIZED_TIME,
+	},
+	AD: {
+		userFilter:  "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=%[1]s)(userPrincipalName=%[1]s)(mail=%[1]s)))",
+		roleFilter:  "(member=%s)",
+		roleAttr:    "cn",
+		subjectAttr: "sAMAccountName",
+		timeFormat:  FILETIME,
+	},
+	FREEIPA: {
+		userFilter:  "(&(objectClass=person)(|(uid=%[1]s)(mail=%[1]s)))",
+		roleFilter:  "(member=%s)",
+		roleAttr:    "cn",
+		subjectAttr: "uid",
+		timeFormat:  GENERALIZED_TIME,
+	},
+	DS389: {
+		userFilter:  "(&(objectClass=inetOrgPerson)(|(uid=%[1]s)(mail=%[1]s)))",
+		roleFilter:  "(|(member=%[1]s)(uniqueMember=%[1]s))",
+		roleAttr:    "cn",
+		subjectAttr: "uid",
+		timeFormat:  GENERALIZED_TIME,
+	},
+}
+
+// applyPreset sets settings of `directory` preset which are not already set
+func (cfg *Config) applyPreset(directory string) {
+	p := presets[directory]
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = p.userFilter
+	}
+	if cfg.RoleFilter == "" {
+		cfg.RoleFilter = p.roleFilter
+	}
+	if cfg.RoleAttr == "" {
+		cfg.RoleAttr = p.roleAttr
+	}
+	if cfg.SubjectAttr == "" {
+		cfg.SubjectAttr = p.subjectAttr
+	}
+	if cfg.WriteBack.LastLoginFormat == "" {
+		cfg.WriteBack.LastLoginFormat = p.timeFormat
+	}
+	if cfg.WriteBack.LastFailureFormat == "" {
+		cfg.WriteBack.LastFailureFormat = p.timeFormat
+	}
+}
+
+// Setup detects directory type from rootDSE when configured as `auto`
+func Setup(cfg *Config) error {
+	if cfg.Directory != AUTO {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout+cfg.BindTimeout+cfg.SearchTimeout)
+	defer cancel()
+	rootDSE, err := cfg.NewClientWithContext(ctx).readRootDSE()
+	if err != nil {
+		return errors.Wrap(err, "while reading rootDSE")
+	}
+	directory := detectDirectory(rootDSE)
+	if directory == "" {
+		logging.Warn().
+			Str("vendor", rootDSE.GetAttributeValue("vendorName")).
+			Msg("cannot detect directory type, keep generic settings")
+		return nil
+	}
+	cfg.applyPreset(directory)
+	logging.Info().
+		Str("directory", directory).
+		Str("vendor", rootDSE.GetAttributeValue("vendorName")).
+		Str("userfilter", cfg.UserFilter).
+		Str("rolefilter", cfg.RoleFilter).
+		Str("subjectattr", cfg.SubjectAttr).
+		Msg("directory type detected")
+	return nil
+}
+
+func (c *client) readRootDSE() (*ldaplib.Entry, error) {
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+	if err := c.bindService(); err != nil {
+		return nil, err
+	}
+	res, err := c.searchEntry("", "(objectClass=*)", []string{
+		"objectClass",
+		"vendorName",
+		"vendorVersion",
+		"namingContexts",
+		"supportedControl",
+		"supportedCapabilities",
+		"supportedFeatures",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, fmt.Errorf("unexpected count of rootDSE entries %d", len(res.Entries))
+	}
+	return res.Entries[0], nil
+}
+
+func detectDirectory(rootDSE *ldaplib.Entry) string {
+	for _, capability := range rootDSE.GetAttributeValues("supportedCapabilities") {
+		if capability == adCapability {
+			return AD
+		}
+	}
+	if strings.Contains(rootDSE.GetAttributeValue("vendorName"), "389") {
+		// FreeIPA runs on 389-ds with its certificate authority suffix
+		for _, namingContext := range rootDSE.GetAttributeValues("namingContexts") {
+			if strings.EqualFold(namingContext, "o=ipaca") {
+				return FREEIPA
+			}
+		}
+		return DS389
+	}
+	for _, objectClass := range rootDSE.GetAttributeValues("objectClass") {
+		if strings.EqualFold(objectClass, "OpenLDAProotDSE") {
+			return OPENLDAP
+		}
+	}
+	for _, attr := range []string{"supportedControl", "supportedFeatures"} {
+		for _, oid := range rootDSE.GetAttributeValues(attr) {
+			if strings.HasPrefix(oid, openldapArc) {
+				return OPENLDAP
+			}
+		}
+	}
+	return ""
+}
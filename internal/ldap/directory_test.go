@@ -0,0 +1,108 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ldaplib "gopkg.in/ldap.v2"
+)
+
+func TestDetectDirectory(t *testing.T) {
+	makeRootDSE := func(attrs map[string][]string) *ldaplib.Entry {
+		return ldaplib.NewEntry("", attrs)
+	}
+	cases := map[string]*ldaplib.Entry{
+		AD: makeRootDSE(map[string][]string{
+			"supportedCapabilities": {"1.2.840.113556.1.4.800", "1.2.840.113556.1.4.1670"},
+		}),
+		FREEIPA: makeRootDSE(map[string][]string{
+			"vendorName":     {"389 Project"},
+			"namingContexts": {"dc=example,dc=com", "o=ipaca"},
+		}),
+		DS389: makeRootDSE(map[string][]string{
+			"vendorName":       {"389 Project"},
+			"namingContexts":   {"dc=example,dc=com"},
+			"supportedControl": {"1.3.6.1.4.1.4203.1.9.1.1"},
+		}),
+		OPENLDAP: makeRootDSE(map[string][]string{
+			"objectClass": {"top", "OpenLDAProotDSE"},
+		}),
+		"": makeRootDSE(map[string][]string{
+			"vendorName": {"Unknown"},
+		}),
+	}
+	for expected, rootDSE := range cases {
+		assert.Equal(t, expected, detectDirectory(rootDSE))
+	}
+}
+
+func TestReadRootDSE(t *testing.T) {
+	c, moq := makeClient(nil)
+	moq.On("searchEntry", "", "(objectClass=*)", []string{
+		"namingContexts",
+		"objectClass",
+		"supportedCapabilities",
+		"supportedControl",
+		"supportedFeatures",
+		"vendorName",
+		"vendorVersion",
+	}).Return(
+		makeLdapResult([]map[string]string{
+			{"dn": "", "objectClass": "OpenLDAProotDSE"},
+		}),
+		nil,
+	)
+	rootDSE, err := c.readRootDSE()
+	assert.NoError(t, err)
+	assert.Equal(t, OPENLDAP, detectDirectory(rootDSE))
+}
+
+func TestPreset(t *testing.T) {
+	t.Run("preset defaults", func(t *testing.T) {
+		c := Config{Directory: AD}
+		assert.NoError(t, c.Validate())
+		assert.Equal(t, presets[AD].userFilter, c.userFilter())
+		assert.Equal(t, "sAMAccountName", c.SubjectAttr)
+		assert.Equal(t, FILETIME, c.WriteBack.LastLoginFormat)
+		assert.Equal(t, FILETIME, c.WriteBack.LastFailureFormat)
+	})
+
+	t.Run("settings override preset", func(t *testing.T) {
+		c := Config{
+			Directory:   OPENLDAP,
+			UserFilter:  "(uid=%s)",
+			SubjectAttr: "mail",
+		}
+		assert.NoError(t, c.Validate())
+		assert.Equal(t, "(uid=%s)", c.userFilter())
+		assert.Equal(t, presets[OPENLDAP].roleFilter, c.roleFilter())
+		assert.Equal(t, "mail", c.SubjectAttr)
+	})
+
+	t.Run("time format overrides preset", func(t *testing.T) {
+		c := Config{
+			Directory: AD,
+			WriteBack: WriteBackConfig{LastLoginFormat: UNIX_TIME},
+		}
+		assert.NoError(t, c.Validate())
+		assert.Equal(t, UNIX_TIME, c.WriteBack.LastLoginFormat)
+		assert.Equal(t, FILETIME, c.WriteBack.LastFailureFormat)
+	})
+
+	t.Run("unknown time format", func(t *testing.T) {
+		c := Config{WriteBack: WriteBackConfig{LastFailureFormat: "epoch"}}
+		assert.Error(t, c.Validate())
+	})
+
+	t.Run("no preset", func(t *testing.T) {
+		c := Config{}
+		assert.NoError(t, c.Validate())
+		assert.Equal(t, userFilter, c.userFilter())
+		assert.Equal(t, "", c.SubjectAttr)
+	})
+
+	t.Run("unknown directory", func(t *testing.T) {
+		c := Config{Directory: "novell"}
+		assert.Error(t, c.Validate())
+	})
+}
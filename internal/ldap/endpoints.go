@@ -0,0 +1,124 @@
+package ldap
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ldaplib "gopkg.in/ldap.v2"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// pinRegistry remembers users recently written, so their reads are sent to
+// write endpoints until replicas are up to date
+type pinRegistry struct {
+	sync.Mutex
+	until map[string]time.Time
+}
+
+func (c *Config) readEndpoints() []string {
+	if len(c.ReadEndpoints) == 0 {
+		return []string{c.Endpoint}
+	}
+	return c.ReadEndpoints
+}
+
+func (c *Config) writeEndpoints() []string {
+	if len(c.WriteEndpoints) == 0 {
+		return []string{c.Endpoint}
+	}
+	return c.WriteEndpoints
+}
+
+// pin sends reads of `keys` (usernames, subjects or DNs) to write endpoints
+// during `ReadAfterWrite`
+func (c *Config) pin(keys ...string) {
+	if c.ReadAfterWrite == 0 || c.pins == nil {
+		return
+	}
+	c.pins.Lock()
+	defer c.pins.Unlock()
+	now := time.Now()
+	for k, until := range c.pins.until {
+		if until.Before(now) {
+			delete(c.pins.until, k)
+		}
+	}
+	for _, key := range keys {
+		if key != "" {
+			c.pins.until[strings.ToLower(key)] = now.Add(c.ReadAfterWrite)
+		}
+	}
+}
+
+func (c *Config) pinned(key string) bool {
+	if key == "" || c.pins == nil {
+		return false
+	}
+	c.pins.Lock()
+	defer c.pins.Unlock()
+	until, ok := c.pins.until[strings.ToLower(key)]
+	return ok && until.After(time.Now())
+}
+
+func (c *client) open() error {
+	return c.openRead("")
+}
+
+// openRead connects to the first available read endpoint, or write endpoint
+// if `key` was recently written
+func (c *client) openRead(key string) error {
+	if c.cfg.pinned(key) {
+		logging.Debug().Str("key", key).Msg("reads pinned to write endpoints")
+		return c.openAny(c.cfg.writeEndpoints())
+	}
+	return c.openAny(c.cfg.readEndpoints())
+}
+
+func (c *client) openAny(endpoints []string) error {
+	var err error
+	for _, endpoint := range endpoints {
+		if err = c.openEndpoint(endpoint); err == nil || c.ctx.Err() != nil {
+			return err
+		}
+		logging.Warn().Err(err).Str("endpoint", endpoint).Msg("cannot connect to ldap endpoint")
+	}
+	return err
+}
+
+func (c *client) openEndpoint(endpoint string) error {
+	if err := c.translateErr(c.conn.openConn(c.ctx, endpoint, c.cfg.Tls)); err != nil {
+		return err
+	}
+	c.endpoint = endpoint
+	return nil
+}
+
+// onPrimary runs `op` on the first write endpoint accepting it, an endpoint
+// replying with a referral is a read-only replica and the next one is tried
+func (c *client) onPrimary(op func() error) error {
+	var err error
+	for _, endpoint := range c.cfg.writeEndpoints() {
+		if err = c.openEndpoint(endpoint); err != nil {
+			if c.ctx.Err() != nil {
+				return err
+			}
+			logging.Warn().Err(err).Str("endpoint", endpoint).Msg("cannot connect to ldap endpoint")
+			continue
+		}
+		err = op()
+		c.conn.Close()
+		if !isReferral(err) {
+			return err
+		}
+		logging.Warn().Str("endpoint", endpoint).Msg("ldap endpoint replied with a referral, it should not be a write endpoint")
+	}
+	return err
+}
+
+func isReferral(err error) bool {
+	ldapErr, ok := errors.Cause(err).(*ldaplib.Error)
+	return ok && ldapErr.ResultCode == ldaplib.LDAPResultReferral
+}
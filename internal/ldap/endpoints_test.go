@@ -0,0 +1,66 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	ldaplib "gopkg.in/ldap.v2"
+)
+
+func TestOpenRead(t *testing.T) {
+	cfg := Config{
+		ReadEndpoints:  []string{"replica1:389", "replica2:389"},
+		WriteEndpoints: []string{"primary:389"},
+		ReadAfterWrite: time.Minute,
+	}
+	assert.NoError(t, cfg.Validate())
+
+	t.Run("failover", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		moq.On("openConn", c.ctx, "replica1:389", false).Return(errors.New("connection refused"))
+		moq.On("openConn", c.ctx, "replica2:389", false).Return(nil)
+		assert.NoError(t, c.openRead("titi"))
+		moq.AssertCalled(t, "openConn", c.ctx, "replica1:389", false)
+		moq.AssertCalled(t, "openConn", c.ctx, "replica2:389", false)
+	})
+
+	t.Run("pinned to primary", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		cfg.pin("TiTi", "uid=titi,ou=users,dc=example,dc=com")
+		moq.On("openConn", c.ctx, "primary:389", false).Return(nil)
+		assert.NoError(t, c.openRead("titi"))
+		moq.AssertNotCalled(t, "openConn", c.ctx, "replica1:389", false)
+	})
+
+	t.Run("pin expired", func(t *testing.T) {
+		cfg := cfg
+		cfg.ReadAfterWrite = time.Nanosecond
+		cfg.pins = &pinRegistry{until: make(map[string]time.Time)}
+		cfg.pin("toto")
+		time.Sleep(time.Millisecond)
+		assert.False(t, cfg.pinned("toto"))
+	})
+}
+
+func TestOnPrimary(t *testing.T) {
+	cfg := Config{
+		WriteEndpoints: []string{"replica:389", "primary:389"},
+	}
+	c, moq := makeClient(&cfg)
+	moq.On("openConn", c.ctx, "replica:389", false).Return(nil)
+	moq.On("openConn", c.ctx, "primary:389", false).Return(nil)
+
+	calls := 0
+	err := c.onPrimary(func() error {
+		calls++
+		if calls == 1 {
+			return errors.Wrap(ldaplib.NewError(ldaplib.LDAPResultReferral, errors.New("referral")), "while modifying")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	moq.AssertNumberOfCalls(t, "Close", 2)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/pkg/errors"
 	ldaplib "gopkg.in/ldap.v2"
@@ -18,36 +19,57 @@ var (
 	ErrUnauthorize = fmt.Errorf("unauthorized for this app/client")
 	// ErrUserNotFound is an error that happens when requested username is not found in ldap database
 	ErrUserNotFound = fmt.Errorf("user not found")
+	// ErrAmbiguousUser is an error that happens when requested username matches several ldap entries
+	ErrAmbiguousUser = fmt.Errorf("several users found")
 	// ErrInvalidCredentials is an error that happens when a user's password is invalid.
 	ErrInvalidCredentials = fmt.Errorf("invalid credentials")
-	// errConnectionTimeout is an error that happens when no one LDAP endpoint responds.
-	errConnectionTimeout = fmt.Errorf("connection timeout")
+	// ErrTimeout is an error that happens when LDAP server does not respond in time.
+	ErrTimeout = fmt.Errorf("directory unavailable")
+	// ErrClaimsUnavailable is an error that happens when claims cannot be searched without user's credentials
+	ErrClaimsUnavailable = fmt.Errorf("claims unavailable without user's credentials")
 	// errMissedUsername is an error that happens
 	errMissedUsername = errors.New("username is missed")
 	// errUnknownUsername is an error that happens
 	errUnknownUsername = errors.New("unknown username")
 
-	// ldap search filter for user
+	// default ldap search filter for user
 	userFilter = "(&(|(objectClass=organizationalPerson)(objectClass=inetOrgPerson))(|(uid=%[1]s)(mail=%[1]s)(userPrincipalName=%[1]s)(sAMAccountName=%[1]s)))"
-	// ldap search filter for roles
+	// default ldap search filter for roles
 	roleFilter = "(member=%s)"
+	// ldap search filter for user by subject attribute
+	subjectFilter = "(%s=%s)"
 )
 
+// User is the ldap entry matching a username
+type User struct {
+	DN string
+	// value to use as hydra subject
+	Subject string
+	// claims collected during authorization (only in `user` bind mode)
+	Claims *hydra.Claim
+	// ldap endpoint which authenticated user
+	Endpoint string
+}
+
 type ConnInterface interface {
 	openConn(ctx context.Context, endpoint string, istls bool) error
 	searchBase(basedn, filter string, attrs []string) (*ldaplib.SearchResult, error)
+	searchEntry(dn, filter string, attrs []string) (*ldaplib.SearchResult, error)
 	Bind(user, password string) error
+	Modify(req *ldaplib.ModifyRequest) error
 	Close()
 }
 
 type conn struct {
 	ldaplib.Client
+	cfg  *Config
+	done chan struct{}
 }
 
 func (c *conn) openConn(ctx context.Context, endpoint string, istls bool) error {
 	var tcpcn net.Conn
 	var err error
-	d := net.Dialer{Timeout: ldaplib.DefaultTimeout}
+	d := net.Dialer{Timeout: c.cfg.ConnectTimeout}
 	tcpcn, err = d.DialContext(ctx, "tcp", endpoint)
 	if err != nil {
 		return errors.Wrap(err, "open tcp to ldap server failed")
@@ -60,11 +82,31 @@ func (c *conn) openConn(ctx context.Context, endpoint string, istls bool) error
 
 	ldapcn.Start()
 	c.Client = ldapcn
+	c.done = make(chan struct{})
+	// abort in-flight operations as soon as request context is done
+	go func(done chan struct{}) {
+		select {
+		case <-ctx.Done():
+			ldapcn.Close()
+		case <-done:
+		}
+	}(c.done)
 	return nil
 }
 
+func (c *conn) Close() {
+	close(c.done)
+	c.Client.Close()
+}
+
+func (c *conn) Bind(user, password string) error {
+	c.SetTimeout(c.cfg.BindTimeout)
+	return c.Client.Bind(user, password)
+}
+
 func (c *conn) searchBase(basedn, filter string, attrs []string) (*ldaplib.SearchResult, error) {
 	req := ldaplib.NewSearchRequest(basedn, ldaplib.ScopeWholeSubtree, ldaplib.NeverDerefAliases, 0, 0, false, filter, attrs, nil)
+	c.SetTimeout(c.cfg.SearchTimeout)
 	res, err := c.Search(req)
 	if err != nil {
 		if ldapErr, ok := err.(*ldaplib.Error); ok && ldapErr.ResultCode == ldaplib.LDAPResultNoSuchObject {
@@ -75,10 +117,24 @@ func (c *conn) searchBase(basedn, filter string, attrs []string) (*ldaplib.Searc
 	return res, nil
 }
 
+func (c *conn) Modify(req *ldaplib.ModifyRequest) error {
+	c.SetTimeout(c.cfg.SearchTimeout)
+	return c.Client.Modify(req)
+}
+
+// searchEntry searches only entry with `dn`
+func (c *conn) searchEntry(dn, filter string, attrs []string) (*ldaplib.SearchResult, error) {
+	req := ldaplib.NewSearchRequest(dn, ldaplib.ScopeBaseObject, ldaplib.NeverDerefAliases, 0, 0, false, filter, attrs, nil)
+	c.SetTimeout(c.cfg.SearchTimeout)
+	return c.Search(req)
+}
+
 type client struct {
 	ctx  context.Context
 	cfg  *Config
 	conn ConnInterface
+	// endpoint of current connection
+	endpoint string
 
 	appId string
 }
@@ -87,7 +143,7 @@ func (cfg *Config) NewClientWithContext(ctx context.Context) *client {
 	return &client{
 		ctx:  ctx,
 		cfg:  cfg,
-		conn: new(conn),
+		conn: &conn{cfg: cfg},
 	}
 }
 
@@ -96,14 +152,52 @@ func (c *client) WithAppId(appId string) *client {
 	return c
 }
 
+// translateErr converts errors due to request cancellation or to server not
+// responding in time
+func (c *client) translateErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if c.ctx.Err() == context.Canceled {
+		return c.ctx.Err()
+	}
+	if c.ctx.Err() == context.DeadlineExceeded || isTimeout(err) {
+		return ErrTimeout
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	cause := errors.Cause(err)
+	if ldapErr, ok := cause.(*ldaplib.Error); ok {
+		cause = ldapErr.Err
+	}
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	// ldap library does not expose any variable for this error
+	return cause == context.DeadlineExceeded || cause.Error() == "ldap: connection timed out"
+}
+
 func (c *client) searchUser(filter string, attrs []string) (*ldaplib.SearchResult, error) {
-	return c.conn.searchBase(c.cfg.Basedn, filter, attrs)
+	res, err := c.conn.searchBase(c.cfg.Basedn, filter, attrs)
+	return res, c.translateErr(err)
 }
 
 func (c *client) searchRoles(filter string, attrs []string) (*ldaplib.SearchResult, error) {
-	basedn := fmt.Sprintf("ou=%s,%s", c.appId, c.cfg.RoleBaseDN)
+	basedn := c.appDN()
 	logging.Debug().Str("basedn", basedn).Str("filter", filter).Msg("will search roles")
-	return c.conn.searchBase(basedn, filter, attrs)
+	res, err := c.conn.searchBase(basedn, filter, attrs)
+	return res, c.translateErr(err)
+}
+
+func (c *client) appDN() string {
+	return fmt.Sprintf("ou=%s,%s", c.appId, c.cfg.RoleBaseDN)
+}
+
+func (c *client) searchEntry(dn, filter string, attrs []string) (*ldaplib.SearchResult, error) {
+	res, err := c.conn.searchEntry(dn, filter, attrs)
+	return res, c.translateErr(err)
 }
 
 func (c *client) bind(bindDN, password string) error {
@@ -111,29 +205,101 @@ func (c *client) bind(bindDN, password string) error {
 	if ldapErr, ok := err.(*ldaplib.Error); ok && ldapErr.ResultCode == ldaplib.LDAPResultInvalidCredentials {
 		return ErrInvalidCredentials
 	}
-	return err
+	return c.translateErr(err)
 }
 
 func (c *client) inAppRole(userDN string) error {
-	_, err := c.findUserRoles(userDN)
+	_, err := c.appRoles(userDN)
 	if err != nil {
 		return errors.Wrap(err, "while checking user in app role")
 	}
 	return nil
 }
 
-func (c *client) findUserDN(username string) (string, error) {
-	entry, err := c.findUserDetails(username, make([]string, 0))
+// findUser searches entry matching username and returns it along with
+// requested attributes
+func (c *client) findUser(username string, attrs []string) (*User, map[string]string, error) {
+	// copied so that slice of caller is not modified
+	attrs = append(make([]string, 0, len(attrs)+1), attrs...)
+	if c.cfg.SubjectAttr != "" && !contains(attrs, c.cfg.SubjectAttr) {
+		attrs = append(attrs, c.cfg.SubjectAttr)
+	}
+	entry, err := c.findUserDetails(username, attrs)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
-	return entry["dn"], nil
+	user := &User{DN: entry["dn"], Subject: username}
+	if c.cfg.SubjectAttr != "" {
+		subject, ok := entry[c.cfg.SubjectAttr]
+		if !ok || subject == "" {
+			return nil, nil, fmt.Errorf("entry %s has no value for subject attribute %s", user.DN, c.cfg.SubjectAttr)
+		}
+		user.Subject = subject
+	}
+	return user, entry, nil
+}
+
+// appRoles returns user's roles for the app, a user without any role is
+// still authorized if its entry matches app filter
+func (c *client) appRoles(userDN string) ([]string, error) {
+	roles, err := c.findUserRoles(userDN)
+	if err == nil {
+		return roles, nil
+	}
+	if errors.Cause(err) != ErrUnauthorize && !isNoSuchObject(err) {
+		return nil, err
+	}
+	filter, filterErr := c.appFilter()
+	if filterErr != nil {
+		return nil, filterErr
+	}
+	if filter == "" {
+		return nil, err
+	}
+	res, filterErr := c.searchEntry(userDN, filter, []string{"1.1"})
+	if filterErr != nil {
+		return nil, errors.Wrap(filterErr, "while evaluating app filter")
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrUnauthorize
+	}
+	return make([]string, 0), nil
+}
+
+// appFilter returns filter granting access to the app either from config or
+// from app entry
+func (c *client) appFilter() (string, error) {
+	if filter, ok := c.cfg.appFiltersMap()[c.appId]; ok {
+		return filter, nil
+	}
+	if c.cfg.AppFilterAttr == "" {
+		return "", nil
+	}
+	res, err := c.searchEntry(c.appDN(), "(objectClass=*)", []string{c.cfg.AppFilterAttr})
+	if isNoSuchObject(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "while searching app filter")
+	}
+	for _, entry := range res.Entries {
+		if filter := entry.GetAttributeValue(c.cfg.AppFilterAttr); filter != "" {
+			return filter, nil
+		}
+	}
+	return "", nil
+}
+
+func isNoSuchObject(err error) bool {
+	ldapErr, ok := errors.Cause(err).(*ldaplib.Error)
+	return ok && ldapErr.ResultCode == ldaplib.LDAPResultNoSuchObject
 }
 
 func (c *client) findUserRoles(userDN string) ([]string, error) {
-	filter := fmt.Sprintf(roleFilter, userDN)
-	res, err := c.searchRoles(filter, []string{"cn"})
+	filter := fmt.Sprintf(c.cfg.roleFilter(), userDN)
+	roleAttr := c.cfg.roleAttr()
+	res, err := c.searchRoles(filter, []string{roleAttr})
 	if err != nil {
 		return nil, errors.Wrap(err, "while searching roles")
 	}
@@ -141,7 +307,7 @@ func (c *client) findUserRoles(userDN string) ([]string, error) {
 	roles := make([]string, 0)
 	for _, v := range res.Entries {
 		for _, attr := range v.Attributes {
-			if attr.Name == "cn" {
+			if strings.EqualFold(attr.Name, roleAttr) {
 				roles = append(roles, attr.Values[0])
 			}
 		}
@@ -153,16 +319,30 @@ func (c *client) findUserRoles(userDN string) ([]string, error) {
 }
 
 func (c *client) findUserDetails(username string, attrs []string) (map[string]string, error) {
-	filter := fmt.Sprintf(userFilter, username)
+	// precedence attributes are needed to pick an entry among several ones,
+	// attrs is copied so that slice of caller is not modified
+	attrs = append(make([]string, 0, len(attrs)+len(c.cfg.Precedence)), attrs...)
+	for _, attr := range c.cfg.Precedence {
+		if !contains(attrs, attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	return c.findEntry(fmt.Sprintf(c.cfg.userFilter(), ldaplib.EscapeFilter(username)), attrs, username)
+}
+
+func (c *client) findSubjectDetails(subject string, attrs []string) (map[string]string, error) {
+	if c.cfg.SubjectAttr == "" {
+		return c.findUserDetails(subject, attrs)
+	}
+	return c.findEntry(fmt.Sprintf(subjectFilter, c.cfg.SubjectAttr, ldaplib.EscapeFilter(subject)), attrs, subject)
+}
+
+func (c *client) findEntry(filter string, attrs []string, login string) (map[string]string, error) {
 	res, err := c.searchUser(filter, attrs)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(res.Entries) != 1 {
-		return nil, ErrUserNotFound
-	}
-
 	var entries []map[string]string
 	for _, v := range res.Entries {
 		entry := map[string]string{
@@ -174,54 +354,262 @@ func (c *client) findUserDetails(username string, attrs []string) (map[string]st
 		}
 		entries = append(entries, entry)
 	}
-	return entries[0], nil
-}
 
-func (c *client) IsAuthorized(username, password string) error {
-	if err := c.conn.openConn(c.ctx, c.cfg.Endpoint, c.cfg.Tls); err != nil {
-		return err
+	switch len(entries) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+		return entries[0], nil
 	}
-	defer c.conn.Close()
-	dn, err := c.findUserDN(username)
-	if err != nil {
-		return err
+	dns := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		dns = append(dns, entry["dn"])
 	}
-	if err := c.bind(dn, password); err != nil {
-		return err
+	if entry := c.pickEntry(entries, login); entry != nil {
+		logging.Info().Str("login", login).Strs("dns", dns).Str("dn", entry["dn"]).
+			Msg("login matches several ldap entries, one was picked according to precedence")
+		return entry, nil
 	}
-	if err := c.inAppRole(dn); err != nil {
-		return err
+	logging.Warn().Str("login", login).Strs("dns", dns).Msg("login matches several ldap entries")
+	return nil, ErrAmbiguousUser
+}
+
+// pickEntry returns the only entry whose attribute equals login, attributes
+// being checked in `Precedence` order
+func (c *client) pickEntry(entries []map[string]string, login string) map[string]string {
+	for _, attr := range c.cfg.Precedence {
+		var matches []map[string]string
+		for _, entry := range entries {
+			if strings.EqualFold(attrValue(entry, attr), login) {
+				matches = append(matches, entry)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			return matches[0]
+		default:
+			return nil
+		}
 	}
 	return nil
 }
 
-func (c *client) FindOIDCClaims(subject string) (*hydra.Claim, error) {
-	if err := c.conn.openConn(c.ctx, c.cfg.Endpoint, c.cfg.Tls); err != nil {
+// attrValue gets value of attribute `name` whatever the case used by server
+func attrValue(entry map[string]string, name string) string {
+	for k, v := range entry {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// IsAuthorized checks username and password against ldap and returns the
+// matching user if it is allowed to access the app
+func (c *client) IsAuthorized(username, password string) (*User, error) {
+	username = c.cfg.Normalize.Normalize(username)
+	if username == "" {
+		return nil, ErrUserNotFound
+	}
+	// an empty password makes an unauthenticated bind, which many servers
+	// accept whatever the DN
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := c.openRead(username); err != nil {
 		return nil, err
 	}
 	defer c.conn.Close()
+	if c.cfg.BindMode == USER_BIND {
+		return c.authorizeAsUser(username, password)
+	}
+	if err := c.bindService(); err != nil {
+		return nil, err
+	}
+	user, _, err := c.findUser(username, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bind(user.DN, password); err != nil {
+		if err == ErrInvalidCredentials {
+			c.recordLogin(user.DN, false, username, user.Subject)
+		}
+		return nil, err
+	}
+	c.recordLogin(user.DN, true, username, user.Subject)
+	if err := c.inAppRole(user.DN); err != nil {
+		return nil, err
+	}
+	user.Endpoint = c.endpoint
+	return user, nil
+}
 
-	attrs := make([]string, 0)
-	for ldapAttrName, _ := range c.cfg.attrsMap() {
-		attrs = append(attrs, ldapAttrName)
+// authorizeAsUser binds with user's credentials before searching anything,
+// claims are collected under this bind as they will not be reachable later
+func (c *client) authorizeAsUser(username, password string) (*User, error) {
+	bindDN := c.userBindDN(username)
+	if err := c.bind(bindDN, password); err != nil {
+		if err == ErrInvalidCredentials && c.cfg.UserDNTemplate != "" {
+			c.recordLogin(bindDN, false, username)
+		}
+		return nil, err
 	}
-	details, err := c.findUserDetails(subject, attrs)
+	user, details, err := c.findUser(username, c.claimAttrs())
 	if err != nil {
 		return nil, err
 	}
-	roles, err := c.findUserRoles(details["dn"])
+	c.recordLogin(user.DN, true, username, user.Subject)
+	claims, err := c.buildClaims(details)
+	if err != nil {
+		return nil, errors.Wrap(err, "while checking user in app role")
+	}
+	user.Claims = claims
+	user.Endpoint = c.endpoint
+	return user, nil
+}
+
+func (c *client) userBindDN(username string) string {
+	if c.cfg.UserDNTemplate != "" {
+		return fmt.Sprintf(c.cfg.UserDNTemplate, escapeDN(username))
+	}
+	if strings.Contains(username, "@") {
+		return username
+	}
+	return fmt.Sprintf("%s@%s", username, c.cfg.UpnDomain)
+}
+
+func (c *client) bindService() error {
+	if c.cfg.Admindn == "" {
+		return nil
+	}
+	err := c.bind(c.cfg.Admindn, c.cfg.Adminpw)
+	if err == ErrInvalidCredentials {
+		// should not be reported as bad user's credentials
+		return fmt.Errorf("invalid credentials for admin account %s", c.cfg.Admindn)
+	}
+	return errors.Wrap(err, "while binding with admin account")
+}
+
+func (c *client) claimAttrs() []string {
+	attrs := make([]string, 0)
+	for ldapAttrName, _ := range c.cfg.clientAttrsMap(c.appId) {
+		if ldapAttrName != ROLES_ATTR {
+			attrs = append(attrs, ldapAttrName)
+		}
+	}
+	return attrs
+}
+
+func (c *client) buildClaims(details map[string]string) (*hydra.Claim, error) {
+	roles, err := c.appRoles(details["dn"])
 	if err != nil {
 		return nil, err
 	}
 	claims := hydra.Claim{
-		Details: make(map[string]string),
+		Details: make(map[string]interface{}),
 		Roles:   roles,
 	}
 
-	for ldapAttr, oidcAttr := range c.cfg.attrsMap() {
-		if value, ok := details[ldapAttr]; ok {
-			claims.Details[oidcAttr] = value
+	for ldapAttr, mapping := range c.cfg.clientAttrsMap(c.appId) {
+		claim, claimType := splitClaim(mapping)
+		if ldapAttr == ROLES_ATTR {
+			claims.RolesClaim = claim
+			continue
+		}
+		value, ok := details[ldapAttr]
+		if !ok {
+			continue
+		}
+		// a malformed value of one entry should not prevent user to login
+		typed, err := claimValue(value, claimType)
+		if err != nil {
+			logging.Warn().Err(err).Str("dn", details["dn"]).Str("attr", ldapAttr).Msg("cannot convert attribute to claim")
+			continue
 		}
+		setClaim(claims.Details, claim, typed)
 	}
 	return &claims, nil
 }
+
+// FindOIDCClaims searches claims of subject, this is not possible in `user`
+// bind mode where claims must be collected by IsAuthorized
+func (c *client) FindOIDCClaims(subject string) (*hydra.Claim, error) {
+	if c.cfg.BindMode == USER_BIND {
+		return nil, ErrClaimsUnavailable
+	}
+	if err := c.openRead(subject); err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+	if err := c.bindService(); err != nil {
+		return nil, err
+	}
+
+	details, err := c.findSubjectDetails(subject, c.claimAttrs())
+	if err != nil {
+		return nil, err
+	}
+	return c.buildClaims(details)
+}
+
+// FindOIDCClaimsByDN searches claims of user entry `dn` found at login time,
+// so that user is not searched again by subject
+func (c *client) FindOIDCClaimsByDN(dn string) (*hydra.Claim, error) {
+	if c.cfg.BindMode == USER_BIND {
+		return nil, ErrClaimsUnavailable
+	}
+	if err := c.openRead(dn); err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+	if err := c.bindService(); err != nil {
+		return nil, err
+	}
+
+	res, err := c.searchEntry(dn, "(objectClass=*)", c.claimAttrs())
+	if isNoSuchObject(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	details := map[string]string{"dn": res.Entries[0].DN}
+	for _, attr := range res.Entries[0].Attributes {
+		details[attr.Name] = attr.Values[0]
+	}
+	return c.buildClaims(details)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeDN escapes special characters of a DN attribute value as described
+// in RFC 4514
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(value)-1 && r == ' ':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -40,7 +40,7 @@ func TestIsAuthorized(t *testing.T) {
 			ldaplib.NewError(ldaplib.LDAPResultInvalidCredentials, errors.New("oups")),
 		)
 
-		err := c.IsAuthorized(username, password)
+		_, err := c.IsAuthorized(username, password)
 		if assert.Error(t, err) {
 			assert.Equal(t, ErrInvalidCredentials, err)
 		}
@@ -57,7 +57,7 @@ func TestIsAuthorized(t *testing.T) {
 			nil,
 		)
 
-		err := c.IsAuthorized(username, password)
+		_, err := c.IsAuthorized(username, password)
 		if assert.Error(t, err) {
 			assert.Equal(t, ErrUserNotFound, err)
 		}
@@ -88,7 +88,7 @@ func TestIsAuthorized(t *testing.T) {
 			password,
 		).Return(nil)
 
-		err := c.IsAuthorized(username, password)
+		_, err := c.IsAuthorized(username, password)
 		if assert.Error(t, err) {
 			assert.Equal(t, ErrUnauthorize, errors.Cause(err))
 		}
@@ -121,8 +121,387 @@ func TestIsAuthorized(t *testing.T) {
 			password,
 		).Return(nil)
 
-		err := c.IsAuthorized(username, password)
+		user, err := c.IsAuthorized(username, password)
 		assert.NoError(t, err)
+		assert.Equal(t, &User{DN: dn, Subject: username}, user)
+	})
+
+	t.Run("normalized username and subject attribute", func(t *testing.T) {
+		c, moq := makeClient(&Config{
+			Normalize:   NormalizeConfig{Trim: true, CaseFold: true, StripDomain: true},
+			SubjectAttr: "uid",
+		})
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, username),
+			[]string{"uid"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn, "uid": "Titi"},
+			}),
+			nil,
+		)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"cn": "admin"},
+			}),
+			nil,
+		)
+		moq.On("Bind",
+			dn,
+			password,
+		).Return(nil)
+
+		user, err := c.IsAuthorized(` EXAMPLE\TiTi `, password)
+		assert.NoError(t, err)
+		assert.Equal(t, &User{DN: dn, Subject: "Titi"}, user)
+	})
+
+	t.Run("escaped username", func(t *testing.T) {
+		c, moq := makeClient(nil)
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, `\2a\29`),
+			make([]string, 0),
+		).Return(
+			makeLdapResult(make([]map[string]string, 0)),
+			nil,
+		)
+
+		_, err := c.IsAuthorized("*)", password)
+		assert.Equal(t, ErrUserNotFound, err)
+	})
+}
+
+func TestAmbiguousUser(t *testing.T) {
+	var (
+		email    = "shared@example.com"
+		password = "secret"
+		entries  = []map[string]string{
+			{"dn": "uid=jdupont,ou=users", "uid": "jdupont", "mail": email},
+			{"dn": "uid=shared,ou=users", "uid": "shared", "mail": email},
+		}
+	)
+	t.Run("no precedence", func(t *testing.T) {
+		c, moq := makeClient(nil)
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, email),
+			make([]string, 0),
+		).Return(
+			makeLdapResult(entries),
+			nil,
+		)
+
+		_, err := c.IsAuthorized(email, password)
+		assert.Equal(t, ErrAmbiguousUser, err)
+	})
+
+	t.Run("precedence cannot pick", func(t *testing.T) {
+		c, moq := makeClient(&Config{Precedence: []string{"uid", "mail"}})
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, email),
+			[]string{"mail", "uid"},
+		).Return(
+			makeLdapResult(entries),
+			nil,
+		)
+
+		_, err := c.IsAuthorized(email, password)
+		assert.Equal(t, ErrAmbiguousUser, err)
+	})
+
+	t.Run("precedence picks entry", func(t *testing.T) {
+		c, moq := makeClient(&Config{Precedence: []string{"uid", "mail"}})
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, "shared"),
+			[]string{"mail", "uid"},
+		).Return(
+			makeLdapResult(entries),
+			nil,
+		)
+		moq.On("Bind", "uid=shared,ou=users", password).Return(nil)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, "uid=shared,ou=users"),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"cn": "admin"},
+			}),
+			nil,
+		)
+
+		user, err := c.IsAuthorized("shared", password)
+		assert.NoError(t, err)
+		assert.Equal(t, "uid=shared,ou=users", user.DN)
+	})
+
+	t.Run("attrs of caller are not modified", func(t *testing.T) {
+		c, moq := makeClient(&Config{Precedence: []string{"uid", "mail"}})
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, "shared"),
+			[]string{"cn", "mail", "uid"},
+		).Return(
+			makeLdapResult(entries),
+			nil,
+		)
+		attrs := make([]string, 1, 3)
+		attrs[0] = "cn"
+		_, err := c.findUserDetails("shared", attrs)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"cn", "", ""}, attrs[:3])
+	})
+}
+
+func TestAppFilter(t *testing.T) {
+	var (
+		username = "titi"
+		dn       = "uid=titi,ou=users,dc=example,dc=com"
+		password = "secret"
+		filter   = "(&(employeeType=staff)(!(departmentNumber=999)))"
+	)
+	setup := func(moq *fakeConn) {
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, username),
+			make([]string, 0),
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn},
+			}),
+			nil,
+		)
+		moq.On("Bind", dn, password).Return(nil)
+	}
+
+	t.Run("filter from config without app entry", func(t *testing.T) {
+		cfg := &Config{AppFilters: []string{"client-id:" + filter}}
+		c, moq := makeClient(cfg)
+		setup(moq)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			(*ldaplib.SearchResult)(nil),
+			ldaplib.NewError(ldaplib.LDAPResultNoSuchObject, errors.New("no such object")),
+		)
+		moq.On("searchEntry", dn, filter, []string{"1.1"}).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn},
+			}),
+			nil,
+		)
+
+		_, err := c.IsAuthorized(username, password)
+		assert.NoError(t, err)
+	})
+
+	t.Run("filter from app entry not matching", func(t *testing.T) {
+		cfg := &Config{AppFilterAttr: "description"}
+		c, moq := makeClient(cfg)
+		setup(moq)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{}),
+			nil,
+		)
+		moq.On("searchEntry", "ou=client-id,ou=groups", "(objectClass=*)", []string{"description"}).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": "ou=client-id,ou=groups", "description": filter},
+			}),
+			nil,
+		)
+		moq.On("searchEntry", dn, filter, []string{"1.1"}).Return(
+			makeLdapResult([]map[string]string{}),
+			nil,
+		)
+
+		_, err := c.IsAuthorized(username, password)
+		assert.Equal(t, ErrUnauthorize, errors.Cause(err))
+	})
+
+	t.Run("group membership is enough", func(t *testing.T) {
+		cfg := &Config{AppFilters: []string{"client-id:" + filter}}
+		c, moq := makeClient(cfg)
+		setup(moq)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"cn": "admin"},
+			}),
+			nil,
+		)
+
+		_, err := c.IsAuthorized(username, password)
+		assert.NoError(t, err)
+		moq.AssertNotCalled(t, "searchEntry", dn, filter, []string{"1.1"})
+	})
+}
+
+func TestEmptyPassword(t *testing.T) {
+	for name, cfg := range map[string]*Config{
+		"service bind": nil,
+		"user bind":    {BindMode: USER_BIND, UserDNTemplate: "uid=%s,ou=users,dc=example,dc=com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, moq := makeClient(cfg)
+			_, err := c.IsAuthorized("titi", "")
+			assert.Equal(t, ErrInvalidCredentials, err)
+			moq.AssertNotCalled(t, "Bind", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestIsAuthorizedAsUser(t *testing.T) {
+	var (
+		username = "titi"
+		dn       = "uid=titi,ou=users,dc=example,dc=com"
+		password = "secret"
+	)
+	t.Run("invalid credential", func(t *testing.T) {
+		c, moq := makeClient(&Config{
+			BindMode:       USER_BIND,
+			UserDNTemplate: "uid=%s,ou=users,dc=example,dc=com",
+		})
+		moq.On("Bind",
+			dn,
+			password,
+		).Return(
+			ldaplib.NewError(ldaplib.LDAPResultInvalidCredentials, errors.New("oups")),
+		)
+
+		_, err := c.IsAuthorized(username, password)
+		assert.Equal(t, ErrInvalidCredentials, err)
+	})
+
+	t.Run("upn bind and claims", func(t *testing.T) {
+		c, moq := makeClient(&Config{
+			BindMode:  USER_BIND,
+			UpnDomain: "example.com",
+			Attrs:     []string{"mail:email"},
+		})
+		moq.On("Bind",
+			"titi@example.com",
+			password,
+		).Return(nil)
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, username),
+			[]string{"mail"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn, "mail": "titi@example.com"},
+			}),
+			nil,
+		)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"cn": "admin"},
+			}),
+			nil,
+		)
+
+		user, err := c.IsAuthorized(username, password)
+		assert.NoError(t, err)
+		expected := &User{
+			DN:      dn,
+			Subject: username,
+			Claims: &hydra.Claim{
+				Details: map[string]interface{}{"email": "titi@example.com"},
+				Roles:   []string{"admin"},
+			},
+		}
+		assert.Equal(t, expected, user)
+	})
+
+	t.Run("claims cannot be searched later", func(t *testing.T) {
+		c, _ := makeClient(&Config{BindMode: USER_BIND})
+		_, err := c.FindOIDCClaims(username)
+		assert.Equal(t, ErrClaimsUnavailable, err)
+	})
+}
+
+func TestServiceBind(t *testing.T) {
+	c, moq := makeClient(&Config{Admindn: "cn=admin", Adminpw: "adminpw"})
+	moq.On("Bind",
+		"cn=admin",
+		"adminpw",
+	).Return(
+		ldaplib.NewError(ldaplib.LDAPResultInvalidCredentials, errors.New("oups")),
+	)
+
+	_, err := c.IsAuthorized("titi", "secret")
+	if assert.Error(t, err) {
+		assert.NotEqual(t, ErrInvalidCredentials, errors.Cause(err))
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	assert.Equal(t, `jdupont`, escapeDN("jdupont"))
+	assert.Equal(t, `dupont\, jean`, escapeDN("dupont, jean"))
+	assert.Equal(t, `\#1\+2\ `, escapeDN("#1+2 "))
+	assert.Equal(t, `a\\b`, escapeDN(`a\b`))
+}
+
+func TestTimeout(t *testing.T) {
+	var (
+		username = "titi"
+		password = "secret"
+	)
+	t.Run("operation timed out", func(t *testing.T) {
+		c, moq := makeClient(nil)
+		moq.On("searchBase",
+			"ou=users",
+			fmt.Sprintf(userFilter, username),
+			make([]string, 0),
+		).Return(
+			(*ldaplib.SearchResult)(nil),
+			ldaplib.NewError(ldaplib.ErrorNetwork, errors.New("ldap: connection timed out")),
+		)
+
+		_, err := c.IsAuthorized(username, password)
+		assert.Equal(t, ErrTimeout, errors.Cause(err))
+	})
+
+	t.Run("request canceled", func(t *testing.T) {
+		c, moq := makeClient(nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.ctx = ctx
+		moq.On("openConn", ctx, "", false).Return(errors.New("operation was canceled"))
+
+		_, err := c.IsAuthorized(username, password)
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	})
+
+	t.Run("request deadline exceeded", func(t *testing.T) {
+		c, moq := makeClient(nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 0)
+		defer cancel()
+		c.ctx = ctx
+		moq.On("openConn", ctx, "", false).Return(errors.New("i/o timeout"))
+
+		_, err := c.IsAuthorized(username, password)
+		assert.Equal(t, ErrTimeout, errors.Cause(err))
 	})
 }
 
@@ -173,7 +552,7 @@ func TestOIDCClaims(t *testing.T) {
 		claims, err := c.FindOIDCClaims(username)
 		assert.NoError(t, err)
 		expected := hydra.Claim{
-			Details: map[string]string{
+			Details: map[string]interface{}{
 				"name":        "Titi",
 				"family_name": "Titi Dupont",
 			},
@@ -183,6 +562,105 @@ func TestOIDCClaims(t *testing.T) {
 	})
 }
 
+func TestOIDCClaimsByDN(t *testing.T) {
+	dn := "uid=titi,ou=users,dc=example,dc=com"
+	cfg := Config{
+		Attrs: []string{"name:name", "sn:family_name"},
+	}
+	t.Run("entry removed", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		moq.On("searchEntry", dn, "(objectClass=*)", []string{"name", "sn"}).Return(
+			makeLdapResult(nil),
+			ldaplib.NewError(ldaplib.LDAPResultNoSuchObject, errors.New("no such object")),
+		)
+		_, err := c.FindOIDCClaimsByDN(dn)
+		assert.Equal(t, ErrUserNotFound, err)
+	})
+
+	t.Run("everything ok", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		moq.On("searchEntry", dn, "(objectClass=*)", []string{"name", "sn"}).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn, "name": "Titi", "sn": "Titi Dupont"},
+			}),
+			nil,
+		)
+		moq.On("searchBase",
+			"ou=client-id,ou=groups",
+			fmt.Sprintf(roleFilter, dn),
+			[]string{"cn"},
+		).Return(
+			makeLdapResult([]map[string]string{
+				{"cn": "admin"},
+			}),
+			nil,
+		)
+		claims, err := c.FindOIDCClaimsByDN(dn)
+		assert.NoError(t, err)
+		expected := hydra.Claim{
+			Details: map[string]interface{}{
+				"name":        "Titi",
+				"family_name": "Titi Dupont",
+			},
+			Roles: []string{"admin"},
+		}
+		assert.Equal(t, &expected, claims)
+		moq.AssertNotCalled(t, "searchBase", "ou=users", mock.Anything, mock.Anything)
+	})
+}
+
+func TestStructuredClaims(t *testing.T) {
+	dn := "uid=titi,ou=users,dc=example,dc=com"
+	cfg := Config{
+		Attrs: []string{
+			"emailVerified:email_verified:bool",
+			"modifyTimestamp:updated_at:epoch",
+			"street:address.street_address",
+			"l:address.locality",
+			"postalCode:address.postal_code",
+			"c:address.country",
+			"employeeNumber:employee_number:int",
+		},
+	}
+	c, moq := makeClient(&cfg)
+	moq.On("searchEntry", dn, "(objectClass=*)", mock.Anything).Return(
+		makeLdapResult([]map[string]string{
+			{
+				"dn":              dn,
+				"emailVerified":   "TRUE",
+				"modifyTimestamp": "20200403081240Z",
+				"street":          "1 rue de la Paix",
+				"l":               "Paris",
+				"postalCode":      "75002",
+				"c":               "FR",
+				"employeeNumber":  "not a number",
+			},
+		}),
+		nil,
+	)
+	moq.On("searchBase", "ou=client-id,ou=groups", mock.Anything, []string{"cn"}).Return(
+		makeLdapResult([]map[string]string{
+			{"cn": "admin"},
+		}),
+		nil,
+	)
+	claims, err := c.FindOIDCClaimsByDN(dn)
+	assert.NoError(t, err)
+	expected := map[string]interface{}{
+		"email_verified": true,
+		"updated_at":     int64(1585901560),
+		"address": map[string]interface{}{
+			"street_address": "1 rue de la Paix",
+			"locality":       "Paris",
+			"postal_code":    "75002",
+			"country":        "FR",
+		},
+	}
+	// malformed employee number is ignored
+	assert.Equal(t, expected, claims.Details)
+	assert.Equal(t, []string{"address", "email_verified", "employee_number", "roles", "updated_at"}, cfg.ClaimNames("client-id"))
+}
+
 func makeLdapResult(entries []map[string]string) *ldaplib.SearchResult {
 	result := ldaplib.SearchResult{Entries: make([]*ldaplib.Entry, 0)}
 	for _, entry := range entries {
@@ -232,16 +710,31 @@ func (c *fakeConn) openConn(ctx context.Context, endpoint string, istls bool) er
 	args := c.Called(ctx, endpoint, istls)
 	return args.Error(0)
 }
+
+// sortedCopy sorts attributes without modifying slice of caller
+func sortedCopy(attrs []string) []string {
+	if attrs == nil {
+		return nil
+	}
+	sorted := append(make([]string, 0, len(attrs)), attrs...)
+	sort.Strings(sorted)
+	return sorted
+}
 func (c *fakeConn) Close() {
 	c.Called()
 }
 func (c *fakeConn) searchBase(basedn, filter string, attrs []string) (*ldaplib.SearchResult, error) {
-	if attrs != nil {
-		sort.Strings(attrs)
-	}
-	args := c.Called(basedn, filter, attrs)
+	args := c.Called(basedn, filter, sortedCopy(attrs))
 	return args.Get(0).(*ldaplib.SearchResult), args.Error(1)
 }
+func (c *fakeConn) searchEntry(dn, filter string, attrs []string) (*ldaplib.SearchResult, error) {
+	args := c.Called(dn, filter, sortedCopy(attrs))
+	return args.Get(0).(*ldaplib.SearchResult), args.Error(1)
+}
+func (c *fakeConn) Modify(req *ldaplib.ModifyRequest) error {
+	args := c.Called(req)
+	return args.Error(0)
+}
 func (c *fakeConn) Bind(username, password string) error {
 	args := c.Called(username, password)
 	return args.Error(0)
@@ -0,0 +1,51 @@
+package ldap
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeConfig lists transformations applied to the username typed in
+// login form before searching it in LDAP
+type NormalizeConfig struct {
+	// remove leading and trailing spaces
+	Trim bool
+	// apply unicode NFKC normalization
+	Nfkc bool
+	// apply unicode case folding
+	CaseFold bool
+	// remove NetBIOS domain prefix (`EXAMPLE\jdupont` becomes `jdupont`)
+	StripDomain bool
+	// UPN suffixes to remove (with `@example.com`, `jdupont@example.com`
+	// becomes `jdupont`)
+	UpnSuffixes []string
+}
+
+func (n *NormalizeConfig) Normalize(username string) string {
+	if n.Trim {
+		username = strings.TrimSpace(username)
+	}
+	if n.Nfkc {
+		username = norm.NFKC.String(username)
+	}
+	if n.CaseFold {
+		username = cases.Fold().String(username)
+	}
+	if n.StripDomain {
+		if idx := strings.LastIndex(username, `\`); idx >= 0 {
+			username = username[idx+1:]
+		}
+	}
+	for _, suffix := range n.UpnSuffixes {
+		if !strings.HasPrefix(suffix, "@") {
+			suffix = "@" + suffix
+		}
+		if len(username) > len(suffix) && strings.EqualFold(username[len(username)-len(suffix):], suffix) {
+			username = username[:len(username)-len(suffix)]
+			break
+		}
+	}
+	return username
+}
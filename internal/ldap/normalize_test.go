@@ -0,0 +1,35 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	n := NormalizeConfig{
+		Trim:        true,
+		Nfkc:        true,
+		CaseFold:    true,
+		StripDomain: true,
+		UpnSuffixes: []string{"example.com", "@corp.example.com"},
+	}
+	cases := map[string]string{
+		"jdupont":                  "jdupont",
+		" JDupont ":                "jdupont",
+		`EXAMPLE\jdupont`:          "jdupont",
+		"jdupont@example.com":      "jdupont",
+		"JDupont@Corp.Example.com": "jdupont",
+		"jdupont@other.com":        "jdupont@other.com",
+		"ｊｄｕｐｏｎｔ":                  "jdupont",
+		"@example.com":             "@example.com",
+	}
+	for input, expected := range cases {
+		assert.Equal(t, expected, n.Normalize(input), "normalizing %q", input)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		n := NormalizeConfig{}
+		assert.Equal(t, ` EXAMPLE\JDupont `, n.Normalize(` EXAMPLE\JDupont `))
+	})
+}
@@ -0,0 +1,196 @@
+package ldap
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ldaplib "gopkg.in/ldap.v2"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// generalized time format as defined in RFC 4517
+const generalizedTime = "20060102150405Z"
+
+// formats of times written back
+const (
+	// generalized time as defined in RFC 4517 (default)
+	GENERALIZED_TIME = "generalized"
+	// 100-nanosecond intervals since 1601-01-01 UTC, as active directory
+	// `lastLogonTimestamp` or `badPasswordTime`
+	FILETIME = "filetime"
+	// seconds since 1970-01-01 UTC
+	UNIX_TIME = "unix"
+)
+
+// seconds between FILETIME epoch (1601-01-01) and unix epoch
+const filetimeEpoch = 11644473600
+
+// WriteBackConfig describes attributes updated (with admin account) after
+// each login attempt, attributes left empty are not written
+type WriteBackConfig struct {
+	Enabled bool
+	// attribute receiving time of last successful login
+	LastLoginAttr string
+	// format of LastLoginAttr: generalized, filetime or unix (default from
+	// directory preset, else generalized)
+	LastLoginFormat string
+	// attribute counting failed attempts since last successful login
+	FailedCountAttr string
+	// attribute receiving time of last failed login
+	LastFailureAttr string
+	// format of LastFailureAttr, as LastLoginFormat
+	LastFailureFormat string
+	// number of concurrent writes (default 4)
+	Workers int
+	// number of pending writes, further login outcomes are dropped until
+	// writes complete (default 100)
+	QueueSize int
+}
+
+type writeBackJob struct {
+	dn      string
+	success bool
+	at      time.Time
+	// other identifiers of user
+	keys []string
+}
+
+// writeBackQueue bounds writes so that a burst of login attempts does not
+// open as many ldap connections
+type writeBackQueue struct {
+	once    sync.Once
+	workers int
+	jobs    chan writeBackJob
+}
+
+func validTimeFormat(format string) bool {
+	switch format {
+	case "", GENERALIZED_TIME, FILETIME, UNIX_TIME:
+		return true
+	}
+	return false
+}
+
+// formatTime formats `t` as expected by an attribute in `format`
+func formatTime(t time.Time, format string) string {
+	switch format {
+	case FILETIME:
+		return strconv.FormatInt((t.Unix()+filetimeEpoch)*1e7+int64(t.Nanosecond()/100), 10)
+	case UNIX_TIME:
+		return strconv.FormatInt(t.Unix(), 10)
+	default:
+		return t.UTC().Format(generalizedTime)
+	}
+}
+
+func newWriteBackQueue(workers, size int) *writeBackQueue {
+	return &writeBackQueue{workers: workers, jobs: make(chan writeBackJob, size)}
+}
+
+// push queues job without blocking, false is returned when queue is full
+func (q *writeBackQueue) push(cfg *Config, job writeBackJob) bool {
+	q.once.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go q.work(cfg)
+		}
+	})
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *writeBackQueue) work(cfg *Config) {
+	for job := range q.jobs {
+		// request context is done before write-back completes
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout+cfg.BindTimeout+2*cfg.SearchTimeout)
+		w := &client{ctx: ctx, cfg: cfg, conn: &conn{cfg: cfg}}
+		if err := w.writeLoginOutcome(job.dn, job.success, job.at); err != nil {
+			logging.Error().Err(err).Str("dn", job.dn).Bool("success", job.success).Msg("cannot record login outcome in ldap")
+		} else {
+			cfg.pin(append(job.keys, job.dn)...)
+		}
+		cancel()
+	}
+}
+
+// recordLogin writes login outcome of user `dn` in background so login is not
+// slowed down, `keys` are other identifiers of this user
+func (c *client) recordLogin(dn string, success bool, keys ...string) {
+	if !c.cfg.WriteBack.Enabled || dn == "" || c.cfg.writeBack == nil {
+		return
+	}
+	job := writeBackJob{dn: dn, success: success, at: time.Now(), keys: keys}
+	if !c.cfg.writeBack.push(c.cfg, job) {
+		logging.Warn().Str("dn", dn).Bool("success", success).Msg("write-back queue is full, login outcome is not recorded")
+	}
+}
+
+func (c *client) writeLoginOutcome(dn string, success bool, at time.Time) error {
+	return c.onPrimary(func() error {
+		return c.modifyLoginOutcome(dn, success, at)
+	})
+}
+
+func (c *client) modifyLoginOutcome(dn string, success bool, at time.Time) error {
+	if err := c.bindService(); err != nil {
+		return err
+	}
+
+	wb := &c.cfg.WriteBack
+	req := ldaplib.NewModifyRequest(dn)
+	if success {
+		if wb.LastLoginAttr != "" {
+			req.Replace(wb.LastLoginAttr, []string{formatTime(at, wb.LastLoginFormat)})
+		}
+		if wb.FailedCountAttr != "" {
+			req.Replace(wb.FailedCountAttr, []string{"0"})
+		}
+	} else {
+		if wb.FailedCountAttr != "" {
+			// concurrent failures may be counted once, this is acceptable
+			// for reporting purpose
+			count, err := c.failedCount(dn)
+			if err != nil {
+				return err
+			}
+			req.Replace(wb.FailedCountAttr, []string{strconv.Itoa(count + 1)})
+		}
+		if wb.LastFailureAttr != "" {
+			req.Replace(wb.LastFailureAttr, []string{formatTime(at, wb.LastFailureFormat)})
+		}
+	}
+	if len(req.ReplaceAttributes) == 0 {
+		return nil
+	}
+	if err := c.conn.Modify(req); err != nil {
+		return errors.Wrap(c.translateErr(err), "while modifying user entry")
+	}
+	return nil
+}
+
+func (c *client) failedCount(dn string) (int, error) {
+	attr := c.cfg.WriteBack.FailedCountAttr
+	res, err := c.searchEntry(dn, "(objectClass=*)", []string{attr})
+	if err != nil {
+		return 0, errors.Wrap(err, "while searching failed attempts count")
+	}
+	if len(res.Entries) != 1 {
+		return 0, ErrUserNotFound
+	}
+	value := res.Entries[0].GetAttributeValue(attr)
+	if value == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad value for %s", attr)
+	}
+	return count, nil
+}
@@ -0,0 +1,107 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ldaplib "gopkg.in/ldap.v2"
+)
+
+func TestWriteLoginOutcome(t *testing.T) {
+	var (
+		dn = "uid=titi,ou=users,dc=example,dc=com"
+		at = time.Date(2020, 5, 4, 10, 20, 30, 0, time.UTC)
+	)
+	cfg := Config{
+		WriteBack: WriteBackConfig{
+			Enabled:         true,
+			LastLoginAttr:   "lastLogin",
+			FailedCountAttr: "failedCount",
+			LastFailureAttr: "lastFailure",
+		},
+	}
+
+	t.Run("success", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		expected := ldaplib.NewModifyRequest(dn)
+		expected.Replace("lastLogin", []string{"20200504102030Z"})
+		expected.Replace("failedCount", []string{"0"})
+		moq.On("Modify", expected).Return(nil)
+
+		assert.NoError(t, c.writeLoginOutcome(dn, true, at))
+		moq.AssertExpectations(t)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		c, moq := makeClient(&cfg)
+		moq.On("searchEntry", dn, "(objectClass=*)", []string{"failedCount"}).Return(
+			makeLdapResult([]map[string]string{
+				{"dn": dn, "failedCount": "2"},
+			}),
+			nil,
+		)
+		expected := ldaplib.NewModifyRequest(dn)
+		expected.Replace("failedCount", []string{"3"})
+		expected.Replace("lastFailure", []string{"20200504102030Z"})
+		moq.On("Modify", expected).Return(nil)
+
+		assert.NoError(t, c.writeLoginOutcome(dn, false, at))
+		moq.AssertExpectations(t)
+	})
+
+	t.Run("nothing to write", func(t *testing.T) {
+		c, moq := makeClient(&Config{
+			WriteBack: WriteBackConfig{Enabled: true, LastLoginAttr: "lastLogin"},
+		})
+
+		assert.NoError(t, c.writeLoginOutcome(dn, false, at))
+		moq.AssertNotCalled(t, "Modify", ldaplib.NewModifyRequest(dn))
+	})
+}
+
+func TestFormatTime(t *testing.T) {
+	at := time.Date(2020, 5, 4, 10, 20, 30, 123456789, time.UTC)
+	assert.Equal(t, "20200504102030Z", formatTime(at, ""))
+	assert.Equal(t, "20200504102030Z", formatTime(at.In(time.FixedZone("CEST", 7200)), GENERALIZED_TIME))
+	assert.Equal(t, "132330612301234567", formatTime(at, FILETIME))
+	assert.Equal(t, "1588587630", formatTime(at, UNIX_TIME))
+	// FILETIME epoch
+	assert.Equal(t, "0", formatTime(time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC), FILETIME))
+}
+
+func TestWriteLoginOutcomeFormat(t *testing.T) {
+	var (
+		dn = "CN=titi,CN=Users,DC=example,DC=com"
+		at = time.Date(2020, 5, 4, 10, 20, 30, 0, time.UTC)
+	)
+	cfg := Config{
+		WriteBack: WriteBackConfig{
+			Enabled:           true,
+			LastLoginAttr:     "lastLogin",
+			LastLoginFormat:   FILETIME,
+			LastFailureAttr:   "lastFailure",
+			LastFailureFormat: UNIX_TIME,
+		},
+	}
+
+	c, moq := makeClient(&cfg)
+	expected := ldaplib.NewModifyRequest(dn)
+	expected.Replace("lastLogin", []string{"132330612300000000"})
+	moq.On("Modify", expected).Return(nil)
+	assert.NoError(t, c.writeLoginOutcome(dn, true, at))
+
+	expected = ldaplib.NewModifyRequest(dn)
+	expected.Replace("lastFailure", []string{"1588587630"})
+	moq.On("Modify", expected).Return(nil)
+	assert.NoError(t, c.writeLoginOutcome(dn, false, at))
+	moq.AssertExpectations(t)
+}
+
+func TestWriteBackQueueFull(t *testing.T) {
+	// without worker, queued jobs are never consumed
+	q := newWriteBackQueue(0, 1)
+	cfg := &Config{}
+	assert.True(t, q.push(cfg, writeBackJob{dn: "uid=titi,ou=users,dc=example,dc=com"}))
+	assert.False(t, q.push(cfg, writeBackJob{dn: "uid=toto,ou=users,dc=example,dc=com"}))
+}
@@ -13,7 +13,7 @@ func zerologMiddleware(ctx *macaron.Context) {
 	// Create a copy of the logger (including internal context slice)
 	// to prevent data race when using UpdateContext.
 	l := logging.Logger.With().Logger()
-	ctx.Req = macaron.Request{ctx.Req.WithContext(l.WithContext(ctx.Req.Context()))}
+	ctx.Req = macaron.Request{Request: ctx.Req.WithContext(l.WithContext(ctx.Req.Context()))}
 
 	start := time.Now()
 
@@ -1,9 +1,10 @@
 package routes
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/go-macaron/csrf"
 	"github.com/pkg/errors"
@@ -11,48 +12,32 @@ import (
 
 	"github.com/stregouet/hydra-ldap/internal/config"
 	"github.com/stregouet/hydra-ldap/internal/hydra"
+	hydraSess "github.com/stregouet/hydra-ldap/internal/hydra/session"
 	"github.com/stregouet/hydra-ldap/internal/ldap"
 	"github.com/stregouet/hydra-ldap/internal/logging"
 )
 
 func ConsentGet(cfg *config.Config) CSRFHandler {
 	return func(ctx *macaron.Context, x csrf.CSRF) {
-		l := logging.FromMacaron(ctx)
 		challenge := ctx.Query("consent_challenge")
-		if challenge == "" {
-			l.Info().Msg("missing consent challenge")
-			ctx.Error(http.StatusBadRequest, "missing consent challenge")
-			return
-		}
-
-		resp, err := hydra.GetConsentRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
-		switch errors.Cause(err) {
-		case nil:
-			break
-		case hydra.ErrChallengeNotFound:
-			l.Error().Err(err).Str("challenge", challenge).
-				Msg("Unknown consent challenge in the OAuth2 provider ")
-			ctx.Error(http.StatusBadRequest, "unknown login challenge")
-			return
-		case hydra.ErrChallengeExpired:
-			l.Info().Err(err).Str("challenge", challenge).
-				Msg("Consent challenge has been used already in the OAuth2 provider")
-			ctx.Error(http.StatusBadRequest, "Login challenge has been used already")
-			return
-		default:
-			l.Error().Err(err).Str("challenge", challenge).
-				Msg("Failed to initiate an OAuth2 consent request")
-			ctx.Error(http.StatusInternalServerError, "internal server error")
+		resp := fetchConsentRequest(ctx, cfg, challenge)
+		if resp == nil {
 			return
 		}
 
 		clientId := resp.Client.Id
 		subject := resp.Subject
-		scopes := resp.RequestedScopes
-		if resp.Skip {
-			redirectURL := accept(ctx, cfg, clientId, subject, challenge, scopes)
+		scopes := cfg.Hydra.GrantedScopes(resp, resp.RequestedScopes)
+		// consent to trusted clients is given without asking user, but user
+		// must still be authorized to access them
+		skip := resp.Skip && !reconsentDue(ctx, cfg, resp)
+		if skip || cfg.Hydra.Trusted(resp.Client) {
+			redirectURL := accept(ctx, cfg, resp, challenge, scopes)
 			if redirectURL != "" {
-				l.Info().Str("challenge", challenge).Msg("consent UI was skipped")
+				logging.FromMacaron(ctx).Info().
+					Str("challenge", challenge).
+					Bool("trusted", !skip).
+					Msg("consent UI was skipped")
 				ctx.Redirect(redirectURL, http.StatusFound)
 			}
 			return
@@ -65,8 +50,7 @@ func ConsentGet(cfg *config.Config) CSRFHandler {
 		ctx.Data["client_id"] = clientId
 		ctx.Data["client_name"] = resp.Client.Name
 		ctx.Data["subject"] = subject
-		ctx.Data["scopes"] = strings.Join(scopes, ",")
-		ctx.Data["scope_labels"] = resp.RequestedScopes
+		ctx.Data["scopes"] = consentScopes(cfg, resp)
 		ctx.HTML(200, "consent")
 	}
 }
@@ -74,52 +58,215 @@ func ConsentGet(cfg *config.Config) CSRFHandler {
 func ConsentPost(cfg *config.Config) CSRFHandler {
 	return func(ctx *macaron.Context, x csrf.CSRF) {
 		challenge := ctx.Query("challenge")
-		clientId := ctx.Query("client_id")
-		subject := ctx.Query("subject")
-		scopes := strings.Split(ctx.Query("scopes"), ",")
 
-		redirectURL := accept(ctx, cfg, clientId, subject, challenge, scopes)
+		// consent request is fetched again as login context and requested
+		// scopes are only known by hydra
+		resp := fetchConsentRequest(ctx, cfg, challenge)
+		if resp == nil {
+			return
+		}
+		scopes := cfg.Hydra.GrantedScopes(resp, ctx.QueryStrings("scopes"))
+		redirectURL := accept(ctx, cfg, resp, challenge, scopes)
 		if redirectURL != "" {
 			ctx.Redirect(redirectURL, http.StatusFound)
 		}
 	}
 }
 
-func accept(ctx *macaron.Context, cfg *config.Config, clientId, subject, challenge string, scopes []string) string {
+type consentScope struct {
+	Name      string
+	Mandatory bool
+}
+
+// consentScopes returns requested scopes shown on consent page, optional ones
+// can be deselected by user
+func consentScopes(cfg *config.Config, resp *hydra.HydraResp) []consentScope {
+	policy := cfg.Hydra.Policy(resp.Client.Id)
+	scopes := make([]consentScope, 0, len(resp.RequestedScopes))
+	for _, scope := range resp.RequestedScopes {
+		if !policy.ScopeAllowed(scope) {
+			continue
+		}
+		scopes = append(scopes, consentScope{
+			Name:      scope,
+			Mandatory: cfg.Hydra.ScopeMandatory(resp.Client.Id, scope),
+		})
+	}
+	return scopes
+}
+
+// reconsentDue tells if consent remembered by hydra is older than re-consent
+// interval of client policy
+func reconsentDue(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp) bool {
+	policy := cfg.Hydra.Policy(resp.Client.Id)
+	if policy.ReconsentAfter == 0 {
+		return false
+	}
+	consentSess, err := hydraSess.FetchConsentSessions(ctx.Req.Context(), &cfg.Hydra, resp.Subject)
+	if err != nil {
+		// consent is asked again rather than trusting a possibly too old one
+		logging.FromMacaron(ctx).Error().Err(err).Msg("while trying to get sessions from hydra")
+		return true
+	}
+	for _, sess := range consentSess {
+		if sess.ConsentRequest.Client.Id == resp.Client.Id {
+			return time.Since(sess.HandledAt) > policy.ReconsentAfter
+		}
+	}
+	return false
+}
+
+// fetchConsentRequest gets consent request from hydra, on error response is
+// already rendered and nil is returned
+func fetchConsentRequest(ctx *macaron.Context, cfg *config.Config, challenge string) *hydra.HydraResp {
+	l := logging.FromMacaron(ctx)
+	if challenge == "" {
+		l.Info().Msg("missing consent challenge")
+		ctx.Error(http.StatusBadRequest, "missing consent challenge")
+		return nil
+	}
+
+	resp, err := hydra.GetConsentRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
+	switch errors.Cause(err) {
+	case nil:
+		return resp
+	case hydra.ErrChallengeNotFound:
+		l.Error().Err(err).Str("challenge", challenge).
+			Msg("Unknown consent challenge in the OAuth2 provider ")
+		ctx.Error(http.StatusBadRequest, "unknown login challenge")
+	case hydra.ErrChallengeExpired:
+		l.Info().Err(err).Str("challenge", challenge).
+			Msg("Consent challenge has been used already in the OAuth2 provider")
+		ctx.Error(http.StatusBadRequest, "Login challenge has been used already")
+	default:
+		l.Error().Err(err).Str("challenge", challenge).
+			Msg("Failed to initiate an OAuth2 consent request")
+		ctx.Error(http.StatusInternalServerError, "internal server error")
+	}
+	return nil
+}
+
+func accept(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp, challenge string, scopes []string) string {
 	l := logging.FromMacaron(ctx)
 	reqCtx := ctx.Req.Context()
-	claims, err := cfg.Ldap.NewClientWithContext(reqCtx).
-		WithAppId(clientId).
-		FindOIDCClaims(subject)
+	subject := resp.Subject
+	loginCtx := consentLoginContext(ctx, cfg, resp)
+	l.Info().
+		Str("challenge", challenge).
+		Str("subject", subject).
+		Str("client", resp.Client.Id).
+		Str("dn", loginCtx.DN).
+		Str("directory", loginCtx.Directory).
+		Str("auth_method", loginCtx.AuthMethod).
+		Int64("auth_time", loginCtx.AuthTime).
+		Str("source_ip", loginCtx.SourceIP).
+		Msg("consent requested")
+	claims, err := findClaims(reqCtx, cfg, resp, loginCtx)
 	switch errors.Cause(err) {
 	case nil:
 		break
 	case ldap.ErrUnauthorize:
 		l.Debug().Str("challenge", challenge).Msg("unable to authorize during consent flow")
+		msg := fmt.Sprintf("user `%s` is not authorized to access this app", subject)
+		if redirectURL := reject(ctx, cfg, hydra.RejectConsentRequest, challenge, hydra.UNAUTHORIZED_ERR, msg); redirectURL != "" {
+			return redirectURL
+		}
 		ctx.Data["error"] = true
-		ctx.Data["msg"] = fmt.Sprintf("user `%s` is not authorized to access this app", subject)
+		ctx.Data["msg"] = msg
 		ctx.HTML(http.StatusUnauthorized, "message")
 		return ""
+	case ldap.ErrTimeout:
+		l.Error().Err(err).Str("challenge", challenge).Msg("ldap server did not respond in time")
+		msg := "directory unavailable, please retry later"
+		if redirectURL := reject(ctx, cfg, hydra.RejectConsentRequest, challenge, hydra.UNAVAILABLE_ERR, msg); redirectURL != "" {
+			return redirectURL
+		}
+		ctx.Data["error"] = true
+		ctx.Data["msg"] = msg
+		ctx.HTML(http.StatusServiceUnavailable, "message")
+		return ""
 	default:
 		l.Error().Err(err).Str("challenge", challenge).
 			Msg("error fetching claim from ldap")
+		if redirectURL := reject(ctx, cfg, hydra.RejectConsentRequest, challenge, hydra.INTERNAL_ERR, "cannot fetch user claims"); redirectURL != "" {
+			return redirectURL
+		}
 		ctx.Error(http.StatusInternalServerError, "internal server error")
 		return ""
 	}
-	claims = hydra.FilterClaims(&cfg.Hydra, claims, scopes)
+	claims = hydra.FilterClaims(&cfg.Hydra, resp.Client.Id, claims, scopes)
 
 	remember := ctx.Query("rememberme") != ""
+	tokenSession := cfg.Hydra.TokenSession(resp.Client.Id, claims)
 	redirectURL, err := hydra.AcceptConsentRequest(
 		reqCtx,
 		&cfg.Hydra,
+		resp.Client.Id,
 		challenge,
 		remember,
 		scopes,
-		claims,
+		resp.RequestedAudience,
+		tokenSession,
 	)
 	if err != nil {
 		l.Error().Str("challenge", challenge).Err(err).Msg("error making accept consent request against hydra ")
 		ctx.Error(http.StatusInternalServerError, "internal server error")
+		return ""
 	}
+	recordConsent(ctx, cfg, resp, scopes, remember, tokenSession)
 	return redirectURL
 }
+
+// recordConsent records consent accepted for `resp`, so that it stays in
+// history of user after hydra forgets it
+func recordConsent(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp, scopes []string, remember bool, tokenSession *hydra.TokenSession) {
+	policy := cfg.Hydra.Policy(resp.Client.Id)
+	consent := hydraSess.ConsentSession{
+		GrantScope:    scopes,
+		GrantAudience: resp.RequestedAudience,
+		HandledAt:     time.Now(),
+		ConsentRequest: hydraSess.ConsentReq{
+			Challenge:       resp.Challenge,
+			Client:          resp.Client,
+			RequestedScopes: resp.RequestedScopes,
+			LoginSessionId:  resp.LoginSessionId,
+		},
+		Remember:    remember && !policy.NeverRemember,
+		RememberFor: int(policy.ConsentRemember.Seconds()),
+		Session:     *tokenSession,
+	}
+	if err := cfg.Store.RecordConsent(resp.Subject, consent); err != nil {
+		logging.FromMacaron(ctx).Error().Err(err).Str("challenge", resp.Challenge).Msg("cannot record consent")
+	}
+}
+
+// findClaims returns claims collected at login time if any, else search them
+// in ldap from user entry found at login time or from subject
+func findClaims(reqCtx context.Context, cfg *config.Config, resp *hydra.HydraResp, loginCtx *hydra.LoginContext) (*hydra.Claim, error) {
+	if loginCtx.Claims != nil {
+		if loginCtx.ClientId == resp.Client.Id {
+			return loginCtx.Claims, nil
+		}
+		// claims and roles were collected for another client and cannot be
+		// searched again in `user` bind mode
+		if cfg.Ldap.BindMode == ldap.USER_BIND {
+			return nil, ldap.ErrUnauthorize
+		}
+	}
+	client := cfg.Ldap.NewClientWithContext(reqCtx).WithAppId(resp.Client.Id)
+	if loginCtx.DN != "" {
+		return client.FindOIDCClaimsByDN(loginCtx.DN)
+	}
+	return client.FindOIDCClaims(resp.Subject)
+}
+
+// consentLoginContext returns verified context of login step, an invalid one
+// is ignored so that user is searched by subject
+func consentLoginContext(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp) *hydra.LoginContext {
+	loginCtx, err := cfg.Hydra.LoginContext(resp)
+	if err != nil {
+		logging.FromMacaron(ctx).Warn().Err(err).Str("subject", resp.Subject).Msg("login context ignored")
+		return &hydra.LoginContext{}
+	}
+	return loginCtx
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+	"gopkg.in/macaron.v1"
+)
+
+// languages of UI, first one is the default
+var supportedLangs = []language.Tag{language.English, language.French}
+
+var langMatcher = language.NewMatcher(supportedLangs)
+
+var translations = map[string]map[string]string{
+	"en": {
+		"title":           "Single Sign On",
+		"asking_auth":     "is asking authentification",
+		"username":        "username",
+		"password":        "password",
+		"remember_me":     "remember me",
+		"login":           "login",
+		"bad_credentials": "bad username or password",
+		"not_authorized":  "user `%s` is not authorized to access this app",
+		"ambiguous_user":  "several accounts match this username, please login with your user id",
+		"unavailable":     "directory unavailable, please retry later",
+		"same_user":       "please login again as `%s`",
+		"hint_user":       "please login as `%s`",
+	},
+	"fr": {
+		"title":           "Authentification unique",
+		"asking_auth":     "demande votre authentification",
+		"username":        "identifiant",
+		"password":        "mot de passe",
+		"remember_me":     "se souvenir de moi",
+		"login":           "connexion",
+		"bad_credentials": "identifiant ou mot de passe incorrect",
+		"not_authorized":  "l'utilisateur `%s` n'est pas autorisé à accéder à cette application",
+		"ambiguous_user":  "plusieurs comptes correspondent à cet identifiant, veuillez utiliser votre identifiant unique",
+		"unavailable":     "annuaire indisponible, veuillez réessayer plus tard",
+		"same_user":       "veuillez vous reconnecter en tant que `%s`",
+		"hint_user":       "veuillez vous connecter en tant que `%s`",
+	},
+}
+
+// setLang selects UI language from `locales` (eg. `ui_locales` of hydra
+// request) or else from Accept-Language header, and makes translations
+// available to templates as `.tr`
+func setLang(ctx *macaron.Context, locales []string) string {
+	var tags []language.Tag
+	for _, locale := range locales {
+		if tag, err := language.Parse(locale); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		tags, _, _ = language.ParseAcceptLanguage(ctx.Req.Header.Get("Accept-Language"))
+	}
+	_, index, confidence := langMatcher.Match(tags...)
+	if confidence == language.No {
+		index = 0
+	}
+	base, _ := supportedLangs[index].Base()
+	lang := base.String()
+	ctx.Data["Lang"] = lang
+	ctx.Data["tr"] = translations[lang]
+	return lang
+}
+
+// tr translates `key` into language selected by setLang
+func tr(ctx *macaron.Context, key string, args ...interface{}) string {
+	lang, _ := ctx.Data["Lang"].(string)
+	msg, ok := translations[lang][key]
+	if !ok {
+		msg = translations["en"][key]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
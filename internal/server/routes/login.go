@@ -1,8 +1,8 @@
 package routes
 
 import (
-	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-macaron/csrf"
 	"github.com/pkg/errors"
@@ -12,37 +12,24 @@ import (
 	"github.com/stregouet/hydra-ldap/internal/hydra"
 	"github.com/stregouet/hydra-ldap/internal/ldap"
 	"github.com/stregouet/hydra-ldap/internal/logging"
+	"github.com/stregouet/hydra-ldap/internal/store"
 )
 
 func LoginGet(cfg *config.Config) CSRFHandler {
 	return func(ctx *macaron.Context, x csrf.CSRF) {
 		l := logging.FromMacaron(ctx)
 		challenge := ctx.Query("login_challenge")
-		if challenge == "" {
-			l.Info().Msg("missing login challenge")
-			ctx.Error(http.StatusBadRequest, "missing login challenge")
-			return
-		}
-		resp, err := hydra.GetLoginRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
-		switch errors.Cause(err) {
-		case nil:
-			break
-		case hydra.ErrChallengeNotFound:
-			l.Error().Err(err).Str("challenge", challenge).Msg("Unknown login challenge in the OAuth2 provider ")
-			ctx.Error(http.StatusBadRequest, "unknown login challenge")
-			return
-		case hydra.ErrChallengeExpired:
-			l.Info().Err(err).Str("challenge", challenge).Msg("Login challenge has been used already in the OAuth2 provider")
-			ctx.Error(http.StatusBadRequest, "Login challenge has been used already")
-			return
-		default:
-			l.Error().Err(err).Str("challenge", challenge).Msg("Failed to initiate an OAuth2 login request")
-			ctx.Error(http.StatusInternalServerError, "internal server error")
+		resp := fetchLoginRequest(ctx, cfg, challenge)
+		if resp == nil {
 			return
 		}
 
-		if resp.Skip {
-			redirectURL, err := hydra.AcceptLoginRequest(ctx.Req.Context(), &cfg.Hydra, false, resp.Subject, challenge)
+		// in `user` bind mode, claims cannot be collected without user's
+		// password, so login form is shown even if hydra allows to skip it,
+		// as well as when client asks for a fresh authentication or when
+		// session is older than client allows
+		if resp.Skip && cfg.Ldap.BindMode != ldap.USER_BIND && !cfg.Hydra.ForceLogin(resp) && !loginExpired(ctx, cfg, resp) {
+			redirectURL, err := hydra.AcceptLoginRequest(ctx.Req.Context(), &cfg.Hydra, resp.Client.Id, false, resp.Subject, challenge, hydra.ACR_SESSION, nil, nil)
 			if err != nil {
 				l.Error().Str("challenge", challenge).Err(err).Msg("error making accept login request against hydra ")
 				ctx.Error(http.StatusInternalServerError, "internal server error")
@@ -58,9 +45,13 @@ func LoginGet(cfg *config.Config) CSRFHandler {
 		ctx.Data["csrf_token"] = x.GetToken()
 		ctx.Data["challenge"] = challenge
 		ctx.Data["login_url"] = ctx.URLFor("login_form")
-		ctx.Data["client_id"] = resp.Client.Id
 		ctx.Data["client_name"] = resp.Client.Name
-		ctx.HTML(200, "login")
+		oidcCtx := resp.OidcContext
+		setLang(ctx, oidcCtx.UiLocales)
+		// username suggested by client is not editable
+		ctx.Data["username"] = oidcCtx.LoginHint
+		ctx.Data["login_hint"] = oidcCtx.LoginHint
+		ctx.HTML(200, loginTemplate(oidcCtx.Display))
 	}
 }
 
@@ -70,59 +61,200 @@ func LoginPost(cfg *config.Config) CSRFHandler {
 		challenge := ctx.Query("challenge")
 		username := ctx.Query("username")
 		password := ctx.Query("password")
-		clientId := ctx.Query("client_id")
-		clientName := ctx.Query("client_name")
 
-		if challenge == "" {
-			l.Info().Msg("missing login challenge")
-			ctx.Error(http.StatusBadRequest, "missing login challenge")
+		// client, expected user and login hint are taken from hydra rather
+		// than from the form, so that user cannot authenticate against
+		// another client or as another user than the one suggested
+		resp := fetchLoginRequest(ctx, cfg, challenge)
+		if resp == nil {
 			return
 		}
+		oidcCtx := resp.OidcContext
+		tmpl := loginTemplate(oidcCtx.Display)
+		clientId := resp.Client.Id
+		subject := ""
+		if resp.Skip {
+			// hydra only accepts the user already authenticated
+			subject = resp.Subject
+		}
 
 		ctx.Data["Title"] = "login-sso"
 		ctx.Data["csrf_token"] = x.GetToken()
 		ctx.Data["challenge"] = challenge
 		ctx.Data["login_url"] = ctx.URLFor("login_form")
-		ctx.Data["client_id"] = clientId
-		ctx.Data["client_name"] = clientName
+		ctx.Data["client_name"] = resp.Client.Name
+		ctx.Data["username"] = username
+		ctx.Data["login_hint"] = oidcCtx.LoginHint
+		setLang(ctx, []string{ctx.Query("lang")})
+
+		// username suggested by client is not editable
+		if oidcCtx.LoginHint != "" && username != oidcCtx.LoginHint {
+			l.Info().Str("challenge", challenge).Msg("username differs from login hint of client")
+			ctx.Data["username"] = oidcCtx.LoginHint
+			ctx.Data["error"] = true
+			ctx.Data["msg"] = tr(ctx, "hint_user", oidcCtx.LoginHint)
+			ctx.HTML(http.StatusUnauthorized, tmpl)
+			return
+		}
 
-		err := cfg.Ldap.NewClientWithContext(ctx.Req.Context()).
+		user, err := cfg.Ldap.NewClientWithContext(ctx.Req.Context()).
 			WithAppId(clientId).
 			IsAuthorized(username, password)
-		switch err {
+		if err == nil && subject != "" && user.Subject != subject {
+			l.Info().Str("challenge", challenge).Msg("authenticated user is not the one of hydra session")
+			ctx.Data["error"] = true
+			ctx.Data["msg"] = tr(ctx, "same_user", subject)
+			ctx.HTML(http.StatusUnauthorized, tmpl)
+			return
+		}
+		switch errors.Cause(err) {
 		case nil:
 			remember := ctx.Query("rememberme") != ""
-			// XXX `subject` parameter could be either email or uid is this a problem?
 			redirectURL, err := hydra.AcceptLoginRequest(
 				ctx.Req.Context(),
 				&cfg.Hydra,
+				clientId,
 				remember,
-				username,
+				user.Subject,
 				challenge,
+				hydra.ACR_PASSWORD,
+				[]string{hydra.AMR_PASSWORD},
+				loginContext(ctx, cfg, user, clientId),
 			)
 			if err != nil {
 				l.Error().Str("challenge", challenge).Err(err).Msg("error making accept login request against hydra ")
 				ctx.Data["error"] = true
 				ctx.Data["msg"] = err.Error()
-				ctx.HTML(http.StatusInternalServerError, "login")
+				ctx.HTML(http.StatusInternalServerError, tmpl)
 			} else {
+				recordDevice(ctx, cfg, resp, user.Subject, remember)
 				ctx.Redirect(redirectURL, http.StatusFound)
 			}
 		case ldap.ErrUnauthorize:
 			l.Debug().Str("challenge", challenge).Msg("unable to authorize")
+			msg := tr(ctx, "not_authorized", username)
+			if redirectURL := reject(ctx, cfg, hydra.RejectLoginRequest, challenge, hydra.UNAUTHORIZED_ERR, msg); redirectURL != "" {
+				ctx.Redirect(redirectURL, http.StatusFound)
+				return
+			}
 			ctx.Data["error"] = true
-			ctx.Data["msg"] = fmt.Sprintf("user `%s` is not authorized to access this app", username)
-			ctx.HTML(http.StatusUnauthorized, "login")
+			ctx.Data["msg"] = msg
+			ctx.HTML(http.StatusUnauthorized, tmpl)
 		case ldap.ErrUserNotFound, ldap.ErrInvalidCredentials:
 			l.Debug().Str("challenge", challenge).Msg("unable to authentificate")
 			ctx.Data["error"] = true
-			ctx.Data["msg"] = "bad username or password"
-			ctx.HTML(http.StatusUnauthorized, "login")
+			ctx.Data["msg"] = tr(ctx, "bad_credentials")
+			ctx.HTML(http.StatusUnauthorized, tmpl)
+		case ldap.ErrAmbiguousUser:
+			l.Info().Str("challenge", challenge).Msg("username matches several accounts")
+			ctx.Data["error"] = true
+			ctx.Data["msg"] = tr(ctx, "ambiguous_user")
+			ctx.HTML(http.StatusUnauthorized, tmpl)
+		case ldap.ErrTimeout:
+			l.Error().Str("challenge", challenge).Err(err).Msg("ldap server did not respond in time")
+			msg := tr(ctx, "unavailable")
+			if redirectURL := reject(ctx, cfg, hydra.RejectLoginRequest, challenge, hydra.UNAVAILABLE_ERR, msg); redirectURL != "" {
+				ctx.Redirect(redirectURL, http.StatusFound)
+				return
+			}
+			ctx.Data["error"] = true
+			ctx.Data["msg"] = msg
+			ctx.HTML(http.StatusServiceUnavailable, tmpl)
 		default:
 			l.Error().Str("challenge", challenge).Err(err).Msg("error trying to authentificate")
+			if redirectURL := reject(ctx, cfg, hydra.RejectLoginRequest, challenge, hydra.INTERNAL_ERR, "authentication failed"); redirectURL != "" {
+				ctx.Redirect(redirectURL, http.StatusFound)
+				return
+			}
 			ctx.Data["error"] = true
 			ctx.Data["msg"] = err.Error()
-			ctx.HTML(http.StatusInternalServerError, "login")
+			ctx.HTML(http.StatusInternalServerError, tmpl)
 		}
 	}
 }
+
+// fetchLoginRequest gets login request from hydra, on error response is
+// already rendered and nil is returned
+func fetchLoginRequest(ctx *macaron.Context, cfg *config.Config, challenge string) *hydra.HydraResp {
+	l := logging.FromMacaron(ctx)
+	if challenge == "" {
+		l.Info().Msg("missing login challenge")
+		ctx.Error(http.StatusBadRequest, "missing login challenge")
+		return nil
+	}
+
+	resp, err := hydra.GetLoginRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
+	switch errors.Cause(err) {
+	case nil:
+		return resp
+	case hydra.ErrChallengeNotFound:
+		l.Error().Err(err).Str("challenge", challenge).Msg("Unknown login challenge in the OAuth2 provider ")
+		ctx.Error(http.StatusBadRequest, "unknown login challenge")
+	case hydra.ErrChallengeExpired:
+		l.Info().Err(err).Str("challenge", challenge).Msg("Login challenge has been used already in the OAuth2 provider")
+		ctx.Error(http.StatusBadRequest, "Login challenge has been used already")
+	default:
+		l.Error().Err(err).Str("challenge", challenge).Msg("Failed to initiate an OAuth2 login request")
+		ctx.Error(http.StatusInternalServerError, "internal server error")
+	}
+	return nil
+}
+
+// loginTemplate returns a compact template when client displays login page
+// in a popup
+func loginTemplate(display string) string {
+	if display == "popup" {
+		return "login_popup"
+	}
+	return "login"
+}
+
+// loginContext returns context passed to consent step, so that user entry is
+// not searched again and authentication can be audited
+func loginContext(ctx *macaron.Context, cfg *config.Config, user *ldap.User, clientId string) *hydra.LoginContext {
+	return &hydra.LoginContext{
+		ClientId:   clientId,
+		Claims:     user.Claims,
+		DN:         user.DN,
+		Directory:  user.Endpoint,
+		AuthMethod: hydra.AMR_PASSWORD,
+		AuthTime:   time.Now().Unix(),
+		SourceIP:   sourceIP(ctx, cfg),
+	}
+}
+
+// recordDevice records login accepted for hydra session of `resp`, so that
+// it is listed on dashboard of user
+func recordDevice(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp, subject string, remember bool) {
+	device := store.Device{
+		SessionId: resp.SessionId,
+		ClientId:  resp.Client.Id,
+		UserAgent: ctx.Req.UserAgent(),
+		SourceIP:  sourceIP(ctx, cfg),
+		Method:    hydra.AMR_PASSWORD,
+		AuthTime:  time.Now(),
+	}
+	if policy := cfg.Hydra.Policy(resp.Client.Id); remember && !policy.NeverRemember && policy.LoginRemember > 0 {
+		device.Expires = device.AuthTime.Add(policy.LoginRemember)
+	}
+	if err := cfg.Store.RecordDevice(subject, device); err != nil {
+		logging.FromMacaron(ctx).Error().Err(err).Str("sid", resp.SessionId).Msg("cannot record login")
+	}
+}
+
+// loginExpired tells if remembered login of hydra session is older than
+// client allows. Authentication time is taken from recorded login, when it is
+// unknown only hydra expiry applies.
+func loginExpired(ctx *macaron.Context, cfg *config.Config, resp *hydra.HydraResp) bool {
+	if _, ok := cfg.Hydra.LoginMaxAge(resp.Client.Id); !ok {
+		return false
+	}
+	device, ok, err := cfg.Store.Device(resp.Subject, resp.SessionId)
+	if err != nil {
+		logging.FromMacaron(ctx).Error().Err(err).Msg("while trying to read recorded login")
+	}
+	if !ok {
+		logging.FromMacaron(ctx).Debug().Str("sid", resp.SessionId).Msg("authentication time of session is unknown")
+	}
+	return cfg.Hydra.LoginExpired(resp.Client.Id, device.AuthTime)
+}
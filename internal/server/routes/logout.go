@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/go-macaron/csrf"
+	"github.com/go-macaron/session"
+	"github.com/pkg/errors"
+	"gopkg.in/macaron.v1"
+
+	"github.com/stregouet/hydra-ldap/internal/config"
+	"github.com/stregouet/hydra-ldap/internal/hydra"
+	hydraSess "github.com/stregouet/hydra-ldap/internal/hydra/session"
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+type SessionHandler func(ctx *macaron.Context, x csrf.CSRF, sess session.Store)
+
+func LogoutGet(cfg *config.Config) SessionHandler {
+	return func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
+		l := logging.FromMacaron(ctx)
+		challenge := ctx.Query("logout_challenge")
+		resp := fetchLogoutRequest(ctx, cfg, challenge)
+		if resp == nil {
+			return
+		}
+
+		if !cfg.Hydra.LogoutConfirm {
+			acceptLogout(ctx, cfg, sess, resp, challenge)
+			return
+		}
+
+		ctx.Data["Title"] = "login-sso"
+		ctx.Data["csrf_token"] = x.GetToken()
+		ctx.Data["challenge"] = challenge
+		ctx.Data["logout_url"] = ctx.URLFor("logout_form")
+		ctx.Data["subject"] = resp.Subject
+		// only apps of the login session being logged out are listed
+		consentSess, err := hydraSess.FetchSessionConsents(ctx.Req.Context(), &cfg.Hydra, resp.Subject, resp.SessionId)
+		if err != nil {
+			// confirmation is still possible without the list of apps
+			l.Error().Err(err).Str("challenge", challenge).Msg("while trying to get sessions from hydra")
+		} else {
+			ctx.Data["sessions"] = consentSess
+		}
+		ctx.HTML(200, "logout")
+	}
+}
+
+func LogoutPost(cfg *config.Config) SessionHandler {
+	return func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
+		l := logging.FromMacaron(ctx)
+		challenge := ctx.Query("challenge")
+		resp := fetchLogoutRequest(ctx, cfg, challenge)
+		if resp == nil {
+			return
+		}
+
+		if ctx.Query("confirm") != "" {
+			acceptLogout(ctx, cfg, sess, resp, challenge)
+			return
+		}
+
+		reason := &hydra.RejectReason{
+			Error:            "access_denied",
+			ErrorDescription: "user refused to logout",
+		}
+		if err := hydra.RejectLogoutRequest(ctx.Req.Context(), &cfg.Hydra, challenge, reason); err != nil {
+			l.Error().Str("challenge", challenge).Err(err).Msg("error making reject logout request against hydra ")
+			ctx.Error(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		l.Info().Str("challenge", challenge).Msg("logout refused by user")
+		ctx.Data["Title"] = "login-sso"
+		ctx.Data["msg"] = "you are still logged in"
+		ctx.HTML(200, "message")
+	}
+}
+
+// fetchLogoutRequest gets logout request from hydra, on error response is
+// already rendered and nil is returned
+func fetchLogoutRequest(ctx *macaron.Context, cfg *config.Config, challenge string) *hydra.LogoutResp {
+	l := logging.FromMacaron(ctx)
+	if challenge == "" {
+		l.Info().Msg("missing logout challenge")
+		ctx.Error(http.StatusBadRequest, "missing logout challenge")
+		return nil
+	}
+
+	resp, err := hydra.GetLogoutRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
+	switch errors.Cause(err) {
+	case nil:
+		return resp
+	case hydra.ErrChallengeNotFound:
+		l.Error().Err(err).Str("challenge", challenge).
+			Msg("Unknown logout challenge in the OAuth2 provider ")
+		ctx.Error(http.StatusBadRequest, "unknown logout challenge")
+	case hydra.ErrChallengeExpired:
+		l.Info().Err(err).Str("challenge", challenge).
+			Msg("Logout challenge has been used already in the OAuth2 provider")
+		ctx.Error(http.StatusBadRequest, "Logout challenge has been used already")
+	default:
+		l.Error().Err(err).Str("challenge", challenge).
+			Msg("Failed to initiate an OAuth2 logout request")
+		ctx.Error(http.StatusInternalServerError, "internal server error")
+	}
+	return nil
+}
+
+// acceptLogout accepts logout request and also ends self-service session if
+// it belongs to the same user
+func acceptLogout(ctx *macaron.Context, cfg *config.Config, sess session.Store, resp *hydra.LogoutResp, challenge string) {
+	l := logging.FromMacaron(ctx)
+	redirectURL, err := hydra.AcceptLogoutRequest(ctx.Req.Context(), &cfg.Hydra, challenge)
+	if err != nil {
+		l.Error().Str("challenge", challenge).Err(err).Msg("error making accept logout request against hydra ")
+		ctx.Error(http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if err := cfg.Store.ForgetDevice(resp.Subject, resp.SessionId); err != nil {
+		l.Error().Err(err).Msg("while trying to forget recorded login")
+	}
+	if user, ok := sess.Get("user").(string); ok && user == resp.Subject {
+		if err := sess.Delete("user"); err != nil {
+			l.Error().Err(err).Msg("while trying to delete `user` from session")
+		}
+		if err := sess.Delete("sid"); err != nil {
+			l.Error().Err(err).Msg("while trying to delete `sid` from session")
+		}
+	}
+	l.Info().Str("challenge", challenge).Msg("logout accepted")
+	ctx.Redirect(redirectURL, http.StatusFound)
+}
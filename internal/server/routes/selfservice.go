@@ -8,11 +8,15 @@ import (
 	"gopkg.in/macaron.v1"
 
 	"github.com/stregouet/hydra-ldap/internal/config"
+	"github.com/stregouet/hydra-ldap/internal/hydra"
 	hydraSess "github.com/stregouet/hydra-ldap/internal/hydra/session"
 	"github.com/stregouet/hydra-ldap/internal/logging"
 	"github.com/stregouet/hydra-ldap/internal/oidc"
 )
 
+// DASHBOARD_PAGE_SIZE is the number of apps listed per dashboard page
+const DASHBOARD_PAGE_SIZE = 10
+
 func SelfService(cfg *config.Config) func(ctx *macaron.Context, sess session.Store, x csrf.CSRF) {
 	return func(ctx *macaron.Context, sess session.Store, x csrf.CSRF) {
 		l := logging.FromMacaron(ctx)
@@ -27,14 +31,71 @@ func SelfService(cfg *config.Config) func(ctx *macaron.Context, sess session.Sto
 				ctx.Data["msg"] = "error while trying to get sessions from hydra"
 				ctx.Data["error"] = true
 			} else {
-				ctx.Data["sessions"] = consentSess
-				ctx.Data["csrf_token"] = x.GetToken()
+				paginate(ctx, consentSess)
+				pastApps(ctx, cfg, subject, consentSess)
+			}
+			ctx.Data["csrf_token"] = x.GetToken()
+			devices, err := cfg.Store.Devices(subject)
+			if err != nil {
+				l.Error().Err(err).Msg("while trying to read recorded logins")
 			}
+			ctx.Data["devices"] = devices
+			ctx.Data["devices_recorded"] = cfg.Store.Enabled()
+			currentSid, _ := sess.Get("sid").(string)
+			ctx.Data["current_sid"] = currentSid
+			ctx.Data["revocable"] = cfg.Hydra.SessionRevocable()
 		}
 		ctx.HTML(200, "dashboard")
 	}
 }
 
+// paginate makes page of consent sessions selected by `page` query parameter
+// available to dashboard
+func paginate(ctx *macaron.Context, consentSess []hydraSess.ConsentSession) {
+	pages := (len(consentSess) + DASHBOARD_PAGE_SIZE - 1) / DASHBOARD_PAGE_SIZE
+	page := ctx.QueryInt("page")
+	if page < 1 {
+		page = 1
+	} else if page > pages && pages > 0 {
+		page = pages
+	}
+	start := (page - 1) * DASHBOARD_PAGE_SIZE
+	end := start + DASHBOARD_PAGE_SIZE
+	if end > len(consentSess) {
+		end = len(consentSess)
+	}
+	ctx.Data["sessions"] = consentSess[start:end]
+	ctx.Data["page"] = page
+	ctx.Data["pages"] = pages
+	if page > 1 {
+		ctx.Data["prev_page"] = page - 1
+	}
+	if page < pages {
+		ctx.Data["next_page"] = page + 1
+	}
+}
+
+// pastApps makes apps whose consents are recorded but no longer remembered
+// by hydra available to dashboard, so that their history can be reached
+func pastApps(ctx *macaron.Context, cfg *config.Config, subject string, consentSess []hydraSess.ConsentSession) {
+	recorded, err := cfg.Store.Consents(subject, "")
+	if err != nil {
+		logging.FromMacaron(ctx).Error().Err(err).Msg("while trying to read recorded consents")
+		return
+	}
+	current := make(map[string]bool, len(consentSess))
+	for _, s := range consentSess {
+		current[s.ConsentRequest.Client.Id] = true
+	}
+	past := make([]hydra.ClientInfo, 0)
+	for _, s := range hydraSess.Filter(recorded) {
+		if !current[s.ConsentRequest.Client.Id] {
+			past = append(past, s.ConsentRequest.Client)
+		}
+	}
+	ctx.Data["past_apps"] = past
+}
+
 func SelfServiceLogin(cfg *config.Config) func(ctx *macaron.Context, sess session.Store) {
 	return func(ctx *macaron.Context, sess session.Store) {
 		l := logging.FromMacaron(ctx)
@@ -60,11 +121,19 @@ func SelfServiceLogout(cfg *config.Config) func(ctx *macaron.Context, sess sessi
 				ctx.Error(http.StatusInternalServerError, "internal server error")
 				return
 			}
+			if err := cfg.Store.ForgetDevices(subject); err != nil {
+				l.Error().Err(err).Msg("while trying to forget recorded logins")
+			}
 			if err := sess.Delete("user"); err != nil {
 				l.Error().Err(err).Msg("while trying to delete `user` from session")
 				ctx.Error(http.StatusInternalServerError, "internal server error")
 				return
 			}
+			if err := sess.Delete("sid"); err != nil {
+				l.Error().Err(err).Msg("while trying to delete `sid` from session")
+				ctx.Error(http.StatusInternalServerError, "internal server error")
+				return
+			}
 		}
 		ctx.Redirect("/", http.StatusSeeOther)
 	}
@@ -81,10 +150,53 @@ func SelfServiceOauth(cfg *config.Config) func(ctx *macaron.Context, sess sessio
 			return
 		}
 		sess.Set("user", claims["sub"])
+		// hydra login session of the dashboard itself, kept when revoking
+		// other sessions
+		if sid, ok := claims["sid"].(string); ok {
+			sess.Set("sid", sid)
+		}
 		ctx.Redirect("/", http.StatusSeeOther)
 	}
 }
 
+// SelfServiceApp shows consent history of user for one app
+func SelfServiceApp(cfg *config.Config) func(ctx *macaron.Context, sess session.Store, x csrf.CSRF) {
+	return func(ctx *macaron.Context, sess session.Store, x csrf.CSRF) {
+		l := logging.FromMacaron(ctx)
+		ctx.Data["Title"] = "login-sso"
+		user := sess.Get("user")
+		if user == nil {
+			ctx.Redirect("/", http.StatusSeeOther)
+			return
+		}
+		subject := user.(string)
+		ctx.Data["user"] = subject
+		clientId := ctx.Params(":clientid")
+		remembered, err := hydraSess.FetchConsentHistory(ctx.Req.Context(), &cfg.Hydra, subject, clientId)
+		if err != nil {
+			l.Error().Err(err).Msg("while trying to get consent history from hydra")
+			ctx.Error(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		recorded, err := cfg.Store.Consents(subject, clientId)
+		if err != nil {
+			l.Error().Err(err).Msg("while trying to read recorded consents")
+			ctx.Error(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		history := hydraSess.MergeHistory(recorded, remembered)
+		if len(history) == 0 {
+			ctx.Error(http.StatusNotFound, "no consent given to this app")
+			return
+		}
+		ctx.Data["client"] = history[0].ConsentRequest.Client
+		ctx.Data["history"] = history
+		ctx.Data["history_recorded"] = cfg.Store.Enabled()
+		ctx.Data["csrf_token"] = x.GetToken()
+		ctx.HTML(200, "app")
+	}
+}
+
 func SelfServiceRevoke(cfg *config.Config) func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
 	return func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
 		l := logging.FromMacaron(ctx)
@@ -102,3 +214,89 @@ func SelfServiceRevoke(cfg *config.Config) func(ctx *macaron.Context, x csrf.CSR
 		ctx.Redirect("/", http.StatusSeeOther)
 	}
 }
+
+// SelfServiceRevokeDevice revokes one login session of user
+func SelfServiceRevokeDevice(cfg *config.Config) SessionHandler {
+	return func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
+		l := logging.FromMacaron(ctx)
+		user := sess.Get("user")
+		if user != nil {
+			subject := user.(string)
+			sid := ctx.Params(":sid")
+			sids, err := loginSessionIds(ctx, cfg, subject)
+			if err != nil {
+				l.Error().Err(err).Msg("while trying to list login sessions")
+				ctx.Error(http.StatusInternalServerError, "internal server error")
+				return
+			}
+			// only sessions of user can be revoked
+			if !contains(sids, sid) {
+				ctx.Error(http.StatusNotFound, "unknown session")
+				return
+			}
+			if err := revokeDevice(ctx, cfg, subject, sid); err != nil {
+				l.Error().Err(err).Msg("while trying to revoke login session")
+				ctx.Error(http.StatusInternalServerError, "internal server error")
+				return
+			}
+		}
+		ctx.Redirect("/", http.StatusSeeOther)
+	}
+}
+
+// SelfServiceRevokeOtherDevices revokes all login sessions of user except
+// the one of the dashboard
+func SelfServiceRevokeOtherDevices(cfg *config.Config) SessionHandler {
+	return func(ctx *macaron.Context, x csrf.CSRF, sess session.Store) {
+		l := logging.FromMacaron(ctx)
+		user := sess.Get("user")
+		if user != nil {
+			subject := user.(string)
+			current, _ := sess.Get("sid").(string)
+			sids, err := loginSessionIds(ctx, cfg, subject)
+			if err != nil {
+				l.Error().Err(err).Msg("while trying to list login sessions")
+				ctx.Error(http.StatusInternalServerError, "internal server error")
+				return
+			}
+			for _, sid := range sids {
+				if sid == current {
+					continue
+				}
+				if err := revokeDevice(ctx, cfg, subject, sid); err != nil {
+					l.Error().Err(err).Msg("while trying to revoke login session")
+					ctx.Error(http.StatusInternalServerError, "internal server error")
+					return
+				}
+			}
+		}
+		ctx.Redirect("/", http.StatusSeeOther)
+	}
+}
+
+// loginSessionIds returns ids of recorded logins of user, and of login
+// sessions hydra still knows through remembered consents (eg. logins done
+// before logins were recorded)
+func loginSessionIds(ctx *macaron.Context, cfg *config.Config, subject string) ([]string, error) {
+	devices, err := cfg.Store.Devices(subject)
+	if err != nil {
+		return nil, err
+	}
+	sids, err := hydraSess.FetchLoginSessionIds(ctx.Req.Context(), &cfg.Hydra, subject)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if !contains(sids, device.SessionId) {
+			sids = append(sids, device.SessionId)
+		}
+	}
+	return sids, nil
+}
+
+func revokeDevice(ctx *macaron.Context, cfg *config.Config, subject, sid string) error {
+	if err := hydraSess.RevokeLoginSession(ctx.Req.Context(), &cfg.Hydra, sid); err != nil {
+		return err
+	}
+	return cfg.Store.ForgetDevice(subject, sid)
+}
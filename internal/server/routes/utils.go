@@ -1,8 +1,50 @@
 package routes
 
 import (
+	"context"
+
 	"github.com/go-macaron/csrf"
 	"gopkg.in/macaron.v1"
+
+	"github.com/stregouet/hydra-ldap/internal/config"
+	"github.com/stregouet/hydra-ldap/internal/hydra"
+	"github.com/stregouet/hydra-ldap/internal/logging"
 )
 
 type CSRFHandler func(ctx *macaron.Context, x csrf.CSRF)
+
+type rejectFunc func(ctx context.Context, cfg *hydra.Config, challenge string, reason *hydra.RejectReason) (string, error)
+
+// reject rejects request through hydra when configured for error `class`, it
+// returns url where user should be redirected or empty string if error
+// should be rendered locally. `description` is only logged as the client
+// gets a generic one
+func reject(ctx *macaron.Context, cfg *config.Config, rejecter rejectFunc, challenge, class, description string) string {
+	l := logging.FromMacaron(ctx)
+	reason := cfg.Hydra.RejectReason(class)
+	if reason == nil {
+		return ""
+	}
+	redirectURL, err := rejecter(ctx.Req.Context(), &cfg.Hydra, challenge, reason)
+	if err != nil {
+		l.Error().Str("challenge", challenge).Err(err).Msg("error making reject request against hydra ")
+		return ""
+	}
+	l.Info().Str("challenge", challenge).Str("error", reason.Error).Str("reason", description).Msg("request rejected through hydra")
+	return redirectURL
+}
+
+// sourceIP returns ip address of user, forwarding headers are only trusted
+// when request comes from a trusted proxy as they are set by client otherwise
+func sourceIP(ctx *macaron.Context, cfg *config.Config) string {
+	return cfg.ClientIP(ctx.Req.RemoteAddr, ctx.Req.Header)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
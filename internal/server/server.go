@@ -46,11 +46,19 @@ func setupRoutes(m *macaron.Macaron, cfg *config.Config) {
 		Post(csrf.Validate, routes.ConsentPost(cfg)).
 		Name("consent_form")
 
+	m.Combo("/auth/logout").
+		Get(routes.LogoutGet(cfg)).
+		Post(csrf.Validate, routes.LogoutPost(cfg)).
+		Name("logout_form")
+
 	m.Get("/", routes.SelfService(cfg))
 
 	m.Get("/login", routes.SelfServiceLogin(cfg))
 	m.Get("/logout", routes.SelfServiceLogout(cfg))
 	m.Get("/oidc/callback", routes.SelfServiceOauth(cfg))
 
+	m.Get("/apps/:clientid", routes.SelfServiceApp(cfg))
 	m.Post("/revoke/:clientid", csrf.Validate, routes.SelfServiceRevoke(cfg))
+	m.Post("/devices/others/revoke", csrf.Validate, routes.SelfServiceRevokeOtherDevices(cfg))
+	m.Post("/devices/:sid/revoke", csrf.Validate, routes.SelfServiceRevokeDevice(cfg))
 }
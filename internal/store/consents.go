@@ -0,0 +1,58 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/stregouet/hydra-ldap/internal/hydra/session"
+)
+
+// consentRecord is a consent given by user, kept in history after hydra
+// forgets it
+type consentRecord struct {
+	Expires time.Time              `json:"expires"`
+	Consent session.ConsentSession `json:"consent"`
+}
+
+// RecordConsent records consent given by user, it is kept ConsentRetention
+func (c *Config) RecordConsent(subject string, consent session.ConsentSession) error {
+	if !c.Enabled() {
+		return nil
+	}
+	if consent.HandledAt.IsZero() {
+		consent.HandledAt = time.Now()
+	}
+	// names sort by time, challenge tells apart consents given at once
+	name := fmt.Sprintf("%020d-%s", consent.HandledAt.UnixNano(), encode(consent.ConsentRequest.Challenge))
+	record := &consentRecord{Expires: consent.HandledAt.Add(c.ConsentRetention), Consent: consent}
+	return c.write(subject, CONSENTS_DIR, name, record)
+}
+
+// Consents returns recorded consents of user to client (any client if
+// empty), most recent first
+func (c *Config) Consents(subject, clientId string) ([]session.ConsentSession, error) {
+	consents := make([]session.ConsentSession, 0)
+	if !c.Enabled() {
+		return consents, nil
+	}
+	err := c.readAll(subject, CONSENTS_DIR, func(content []byte, now time.Time) (bool, error) {
+		var record consentRecord
+		if err := json.Unmarshal(content, &record); err != nil {
+			return false, err
+		}
+		expired := now.After(record.Expires)
+		if !expired && (clientId == "" || record.Consent.ConsentRequest.Client.Id == clientId) {
+			consents = append(consents, record.Consent)
+		}
+		return expired, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(consents, func(i, j int) bool {
+		return consents[i].HandledAt.After(consents[j].HandledAt)
+	})
+	return consents, nil
+}
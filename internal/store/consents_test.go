@@ -0,0 +1,54 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stregouet/hydra-ldap/internal/hydra"
+	"github.com/stregouet/hydra-ldap/internal/hydra/session"
+)
+
+func TestConsents(t *testing.T) {
+	cfg := makeStore(t)
+	defer os.RemoveAll(cfg.Dir)
+	cfg.ConsentRetention = 24 * time.Hour
+
+	now := time.Now()
+	consent := func(challenge, clientId string, at time.Time) session.ConsentSession {
+		return session.ConsentSession{
+			HandledAt:  at,
+			GrantScope: []string{"openid"},
+			ConsentRequest: session.ConsentReq{
+				Challenge: challenge,
+				Client:    hydra.ClientInfo{Id: clientId},
+			},
+			Session: hydra.TokenSession{IDToken: map[string]interface{}{"email": "jdupont@example.com"}},
+		}
+	}
+	assert.NoError(t, cfg.RecordConsent("jdupont", consent("first", "wiki", now.Add(-time.Hour))))
+	assert.NoError(t, cfg.RecordConsent("jdupont", consent("second", "wiki", now)))
+	assert.NoError(t, cfg.RecordConsent("jdupont", consent("chat", "chat", now)))
+	assert.NoError(t, cfg.RecordConsent("mmartin", consent("other", "wiki", now)))
+	// consent older than retention
+	assert.NoError(t, cfg.RecordConsent("jdupont", consent("old", "wiki", now.Add(-48*time.Hour))))
+
+	challenges := func(consents []session.ConsentSession) []string {
+		var result []string
+		for _, c := range consents {
+			result = append(result, c.ConsentRequest.Challenge)
+		}
+		return result
+	}
+	consents, err := cfg.Consents("jdupont", "wiki")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"second", "first"}, challenges(consents))
+	assert.Equal(t, "jdupont@example.com", consents[0].Session.IDToken["email"])
+	assert.True(t, consents[0].HandledAt.Equal(now))
+
+	consents, err = cfg.Consents("jdupont", "")
+	assert.NoError(t, err)
+	assert.Len(t, consents, 3)
+}
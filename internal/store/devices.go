@@ -0,0 +1,102 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Device is a login of user recorded when login request is accepted
+type Device struct {
+	// hydra login session id (`sid` claim of id token)
+	SessionId string `json:"sid"`
+	// client which user logged in
+	ClientId  string `json:"client_id"`
+	UserAgent string `json:"user_agent"`
+	SourceIP  string `json:"source_ip"`
+	// authentication method reference
+	Method   string    `json:"method"`
+	AuthTime time.Time `json:"auth_time"`
+	// when record is removed, hydra has forgotten login by then
+	Expires time.Time `json:"expires"`
+}
+
+// RecordDevice records login of user, replacing previous record of the same
+// hydra session. Expiry is bounded by DeviceRetention.
+func (c *Config) RecordDevice(subject string, d Device) error {
+	if !c.Enabled() || d.SessionId == "" {
+		return nil
+	}
+	if d.AuthTime.IsZero() {
+		d.AuthTime = time.Now()
+	}
+	if max := d.AuthTime.Add(c.DeviceRetention); d.Expires.IsZero() || d.Expires.After(max) {
+		d.Expires = max
+	}
+	return c.write(subject, DEVICES_DIR, encode(d.SessionId), &d)
+}
+
+// decodeDevice returns a decodeFunc keeping device in `device`
+func decodeDevice(device *Device) decodeFunc {
+	return func(content []byte, now time.Time) (bool, error) {
+		if err := json.Unmarshal(content, device); err != nil {
+			return false, err
+		}
+		return now.After(device.Expires), nil
+	}
+}
+
+// Devices returns recorded logins of user, most recent first
+func (c *Config) Devices(subject string) ([]Device, error) {
+	devices := make([]Device, 0)
+	if !c.Enabled() {
+		return devices, nil
+	}
+	err := c.readAll(subject, DEVICES_DIR, func(content []byte, now time.Time) (bool, error) {
+		var device Device
+		expired, err := decodeDevice(&device)(content, now)
+		if err == nil && !expired {
+			devices = append(devices, device)
+		}
+		return expired, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].AuthTime.After(devices[j].AuthTime)
+	})
+	return devices, nil
+}
+
+// Device returns recorded login `sessionId` of user, ok is false if it is
+// unknown
+func (c *Config) Device(subject, sessionId string) (device Device, ok bool, err error) {
+	if !c.Enabled() || sessionId == "" {
+		return Device{}, false, nil
+	}
+	ok, err = read(c.recordPath(subject, DEVICES_DIR, encode(sessionId)), time.Now(), decodeDevice(&device))
+	if !ok {
+		return Device{}, false, err
+	}
+	return device, true, nil
+}
+
+// ForgetDevice removes recorded login `sessionId` of user
+func (c *Config) ForgetDevice(subject, sessionId string) error {
+	if !c.Enabled() || sessionId == "" {
+		return nil
+	}
+	return c.remove(subject, DEVICES_DIR, encode(sessionId))
+}
+
+// ForgetDevices removes recorded logins of user
+func (c *Config) ForgetDevices(subject string) error {
+	if !c.Enabled() {
+		return nil
+	}
+	return errors.Wrap(os.RemoveAll(c.recordDir(subject, DEVICES_DIR)), "while removing records")
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeStore(t *testing.T) *Config {
+	dir, err := ioutil.TempDir("", "hydra-ldap-store")
+	assert.NoError(t, err)
+	cfg := &Config{Dir: dir, DeviceRetention: 24 * time.Hour}
+	assert.NoError(t, cfg.Validate())
+	return cfg
+}
+
+func TestDevices(t *testing.T) {
+	cfg := makeStore(t)
+	defer os.RemoveAll(cfg.Dir)
+
+	now := time.Now()
+	laptop := Device{SessionId: "laptop", ClientId: "wiki", UserAgent: "Firefox", SourceIP: "192.0.2.1", Method: "pwd", AuthTime: now.Add(-time.Hour)}
+	phone := Device{SessionId: "phone", ClientId: "wiki", AuthTime: now, Expires: now.Add(time.Hour)}
+	assert.NoError(t, cfg.RecordDevice("jdupont", laptop))
+	assert.NoError(t, cfg.RecordDevice("jdupont", phone))
+	assert.NoError(t, cfg.RecordDevice("mmartin", Device{SessionId: "other", AuthTime: now}))
+	// login of an expired session and login without session id are not listed
+	assert.NoError(t, cfg.RecordDevice("jdupont", Device{SessionId: "old", AuthTime: now.Add(-48 * time.Hour)}))
+	assert.NoError(t, cfg.RecordDevice("jdupont", Device{AuthTime: now}))
+
+	ids := func(devices []Device) []string {
+		var result []string
+		for _, d := range devices {
+			result = append(result, d.SessionId)
+		}
+		return result
+	}
+	devices, err := cfg.Devices("jdupont")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"phone", "laptop"}, ids(devices))
+	// expiry defaults to retention
+	assert.True(t, devices[1].Expires.Equal(laptop.AuthTime.Add(24*time.Hour)))
+	assert.Equal(t, "Firefox", devices[1].UserAgent)
+
+	device, ok, err := cfg.Device("jdupont", "laptop")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "192.0.2.1", device.SourceIP)
+	_, ok, err = cfg.Device("jdupont", "old")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, err = cfg.Device("mmartin", "laptop")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, cfg.ForgetDevice("jdupont", "phone"))
+	assert.NoError(t, cfg.ForgetDevice("jdupont", "unknown"))
+	devices, err = cfg.Devices("jdupont")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"laptop"}, ids(devices))
+
+	assert.NoError(t, cfg.ForgetDevices("jdupont"))
+	devices, err = cfg.Devices("jdupont")
+	assert.NoError(t, err)
+	assert.Empty(t, devices)
+}
+
+func TestSessionIdIsEncoded(t *testing.T) {
+	cfg := makeStore(t)
+	defer os.RemoveAll(cfg.Dir)
+
+	assert.NoError(t, cfg.RecordDevice("../jdupont", Device{SessionId: "../../escape"}))
+	files, err := ioutil.ReadDir(cfg.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	_, ok, err := cfg.Device("../jdupont", "../../escape")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestDisabledStore(t *testing.T) {
+	cfg := &Config{}
+	assert.NoError(t, cfg.Validate())
+	assert.False(t, cfg.Enabled())
+	assert.NoError(t, cfg.RecordDevice("jdupont", Device{SessionId: "laptop"}))
+	devices, err := cfg.Devices("jdupont")
+	assert.NoError(t, err)
+	assert.Empty(t, devices)
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/hydra-ldap/internal/logging"
+)
+
+// directories of records in the directory of each user
+const (
+	DEVICES_DIR  = "devices"
+	CONSENTS_DIR = "consents"
+)
+
+// prefix of files being written, they are renamed once complete
+const tmpPrefix = ".tmp-"
+
+// Config describes the directory where logins and consents of users are
+// recorded, so that devices and consent history are listed by every instance.
+// Each record is a separate file replaced atomically, so that the directory
+// can be shared by instances (eg. a network volume).
+type Config struct {
+	// directory of records, logins and consents are not recorded if empty
+	Dir string
+	// how long a login is kept when hydra does not remember it for a known
+	// duration (default 720h)
+	DeviceRetention time.Duration
+	// how long a consent is kept in history (default 8760h)
+	ConsentRetention time.Duration
+	// interval between purges of expired records of all users (default 1h)
+	PurgeInterval time.Duration
+
+	janitor *sync.Once
+}
+
+func (c *Config) Validate() error {
+	if c.DeviceRetention == 0 {
+		c.DeviceRetention = 720 * time.Hour
+	}
+	if c.ConsentRetention == 0 {
+		c.ConsentRetention = 8760 * time.Hour
+	}
+	if c.PurgeInterval == 0 {
+		c.PurgeInterval = time.Hour
+	}
+	if c.DeviceRetention < 0 || c.ConsentRetention < 0 || c.PurgeInterval < 0 {
+		return fmt.Errorf("store retentions and purge interval should be positive")
+	}
+	c.janitor = &sync.Once{}
+	if c.Dir == "" {
+		logging.Warn().Msg("no store directory configured, devices and consent history are not recorded")
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Wrap(err, "while validating Store.Config")
+	}
+	return nil
+}
+
+// Enabled tells if logins and consents are recorded
+func (c *Config) Enabled() bool {
+	return c.Dir != ""
+}
+
+// encode makes a file name of an identifier given by user or hydra
+func encode(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func (c *Config) recordDir(subject, kind string) string {
+	return filepath.Join(c.Dir, encode(subject), kind)
+}
+
+func (c *Config) recordPath(subject, kind, name string) string {
+	return filepath.Join(c.recordDir(subject, kind), name+".json")
+}
+
+// write replaces record `name` of user with `value`, readers never see a
+// partially written record
+func (c *Config) write(subject, kind, name string, value interface{}) error {
+	c.startJanitor()
+	content, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "while encoding record")
+	}
+	dir := c.recordDir(subject, kind)
+	var tmp *os.File
+	// directory left empty may be removed by a concurrent purge
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return errors.Wrap(err, "while creating record directory")
+		}
+		if tmp, err = ioutil.TempFile(dir, tmpPrefix); !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "while creating record")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "while writing record")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "while writing record")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), c.recordPath(subject, kind, name)), "while writing record")
+}
+
+// remove deletes record `name` of user, an unknown record is ignored
+func (c *Config) remove(subject, kind, name string) error {
+	if err := os.Remove(c.recordPath(subject, kind, name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "while removing record")
+	}
+	return nil
+}
+
+// decodeFunc decodes a record, expired is true when record should be removed
+type decodeFunc func(content []byte, now time.Time) (expired bool, err error)
+
+// read decodes record at `path`, an expired record is removed. ok is false if
+// record is unknown, expired or invalid.
+func read(path string, now time.Time, decode decodeFunc) (ok bool, err error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "while reading record")
+	}
+	expired, err := decode(content, now)
+	if err != nil {
+		logging.Warn().Err(err).Str("file", path).Msg("invalid record ignored")
+		return false, nil
+	}
+	if expired {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logging.Warn().Err(err).Str("file", path).Msg("cannot remove expired record")
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// readAll decodes all records of `kind` of user
+func (c *Config) readAll(subject, kind string, decode decodeFunc) error {
+	dir := c.recordDir(subject, kind)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "while listing records")
+	}
+	now := time.Now()
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if _, err := read(filepath.Join(dir, file.Name()), now, decode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiry decodes the expiry shared by all records
+func expiry(content []byte, now time.Time) (bool, error) {
+	var r struct {
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(content, &r); err != nil {
+		return false, err
+	}
+	return now.After(r.Expires), nil
+}
+
+func (c *Config) startJanitor() {
+	c.janitor.Do(func() {
+		go func() {
+			for range time.Tick(c.PurgeInterval) {
+				c.purge(time.Now())
+			}
+		}()
+	})
+}
+
+// purge removes expired records of all users, including users who never log
+// in again, and directories left empty
+func (c *Config) purge(now time.Time) {
+	subjects, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		logging.Error().Err(err).Str("dir", c.Dir).Msg("cannot purge expired records")
+		return
+	}
+	for _, subject := range subjects {
+		if !subject.IsDir() {
+			continue
+		}
+		subjectDir := filepath.Join(c.Dir, subject.Name())
+		for _, kind := range []string{DEVICES_DIR, CONSENTS_DIR} {
+			dir := filepath.Join(subjectDir, kind)
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				path := filepath.Join(dir, file.Name())
+				if strings.HasPrefix(file.Name(), tmpPrefix) {
+					// left by an instance stopped while writing
+					if now.Sub(file.ModTime()) > c.PurgeInterval {
+						os.Remove(path)
+					}
+					continue
+				}
+				if _, err := read(path, now, expiry); err != nil {
+					logging.Error().Err(err).Str("file", path).Msg("cannot purge record")
+				}
+			}
+			// only removed when empty
+			os.Remove(dir)
+		}
+		os.Remove(subjectDir)
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurge(t *testing.T) {
+	cfg := makeStore(t)
+	defer os.RemoveAll(cfg.Dir)
+
+	now := time.Now()
+	assert.NoError(t, cfg.RecordDevice("jdupont", Device{SessionId: "laptop", AuthTime: now}))
+	// user who never logs in again
+	assert.NoError(t, cfg.RecordDevice("mmartin", Device{SessionId: "phone", AuthTime: now.Add(-time.Hour), Expires: now.Add(-time.Minute)}))
+	// file left by an interrupted write
+	tmp := filepath.Join(cfg.recordDir("jdupont", DEVICES_DIR), tmpPrefix+"1")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte("{"), 0600))
+	old := now.Add(-2 * cfg.PurgeInterval)
+	assert.NoError(t, os.Chtimes(tmp, old, old))
+
+	cfg.purge(now)
+
+	subjects, err := ioutil.ReadDir(cfg.Dir)
+	assert.NoError(t, err)
+	if assert.Len(t, subjects, 1) {
+		assert.Equal(t, encode("jdupont"), subjects[0].Name())
+	}
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+	_, ok, err := cfg.Device("jdupont", "laptop")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestInvalidRetention(t *testing.T) {
+	cfg := &Config{DeviceRetention: -time.Hour}
+	assert.Error(t, cfg.Validate())
+}